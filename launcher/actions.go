@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type nodeAction int
+
+const (
+	actionNone nodeAction = iota
+	actionRestart
+	actionReinstall
+	actionReclone
+	actionRecreate
+	actionDelete
+	actionCordon
+	actionUncordon
+)
+
+func (a nodeAction) String() string {
+	switch a {
+	case actionRestart:
+		return "restart process"
+	case actionReinstall:
+		return "reinstall basics"
+	case actionReclone:
+		return "force re-clone"
+	case actionRecreate:
+		return "recreate VM"
+	case actionDelete:
+		return "delete VM"
+	case actionCordon:
+		return "cordon"
+	case actionUncordon:
+		return "uncordon"
+	}
+	return "none"
+}
+
+// Destructive actions lose training progress or a VM and need confirmation in the TUI.
+func (a nodeAction) Destructive() bool {
+	switch a {
+	case actionRestart, actionReclone, actionRecreate, actionDelete:
+		return true
+	}
+	return false
+}
+
+// nodeControl is how the TUI talks to a node's Watch goroutine. Actions are queued here and
+// picked up by Watch between iterations; a node with queued actions leaves its group first.
+type nodeControl struct {
+	mutex    sync.Mutex
+	pending  []nodeAction
+	current  nodeAction
+	cordoned bool
+	progress string
+}
+
+func (c *nodeControl) Enqueue(action nodeAction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch action {
+	case actionCordon, actionDelete:
+		// cordon right away so the node is dropped from its group
+		c.cordoned = true
+	case actionUncordon:
+		c.cordoned = false
+		c.progress = "uncordoned"
+		return
+	}
+	c.pending = append(c.pending, action)
+	c.progress = fmt.Sprintf("%s: queued", action)
+}
+
+func (c *nodeControl) next() (nodeAction, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.pending) == 0 {
+		return actionNone, false
+	}
+	c.current = c.pending[0]
+	c.pending = c.pending[1:]
+	return c.current, true
+}
+
+func (c *nodeControl) setProgress(progress string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.progress = fmt.Sprintf("%s: %s", c.current, progress)
+}
+
+func (c *nodeControl) finish(err error) {
+	if err != nil {
+		c.setProgress("failed: " + err.Error())
+	} else {
+		c.setProgress("done")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current = actionNone
+}
+
+// state is what goes into TpuStatusUpdate.
+func (c *nodeControl) state() (cordoned bool, busy bool, progress string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cordoned, len(c.pending) > 0 || c.current != actionNone, c.progress
+}
+
+// Command queues an action for a node. It is the only way the TUI changes what a node does.
+func (w *TpuWatcher) Command(id int, action nodeAction) {
+	if w.remote != nil {
+		err := w.remote.client.Command(id, action)
+		if err != nil {
+			w.events.Error(id, err)
+		}
+		return
+	}
+	w.controls[id].Enqueue(action)
+}
+
+func (t *TpuInstaller) stopIfRunning(ctx context.Context, progress func(string), report func(stopStage)) error {
+	if t.runningPid == -1 {
+		return nil
+	}
+	progress("stopping process")
+	return t.StopRunningProcess(ctx, false, report)
+}
+
+// runNodeAction carries out an action on the node. progress is called before every slow step.
+func runNodeAction(ctx context.Context, action nodeAction, installer *TpuInstaller, restarts *restartTracker, progress func(string), report func(stopStage)) error {
+	running := installer.tpuController.latestStatus == tpuStatusRunning
+	switch action {
+	case actionRestart:
+		// a restart asked for by hand goes through even if the policy or a crash loop would hold it
+		restarts.AllowRestart()
+		return installer.stopIfRunning(ctx, progress, report)
+	case actionReinstall:
+		if !running {
+			return fmt.Errorf("tpu must be running to reinstall")
+		}
+		progress("installing")
+		return installer.InstallBasics(ctx)
+	case actionReclone:
+		if !running {
+			return fmt.Errorf("tpu must be running to re-clone")
+		}
+		err := installer.stopIfRunning(ctx, progress, report)
+		if err != nil {
+			return err
+		}
+		progress("cloning")
+		return installer.CloneRepo(ctx)
+	case actionRecreate:
+		// the VM is created again on the next iteration
+		progress("deleting VM")
+		return installer.tpuController.delete(ctx)
+	case actionDelete:
+		progress("deleting VM")
+		return installer.tpuController.delete(ctx)
+	case actionCordon:
+		return installer.stopIfRunning(ctx, progress, report)
+	}
+	return nil
+}
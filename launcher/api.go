@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Wire formats of what the daemon serves. The in-memory types keep their unexported fields;
+// these only exist so they can cross the control socket and come back out the same.
+
+type statusUpdateJson struct {
+	Id          int           `json:"id"`
+	Status      tpuStatus     `json:"status"`
+	Info        tpuInfo       `json:"info"`
+	Installed   bool          `json:"installed"`
+	Cloned      bool          `json:"cloned"`
+	Running     bool          `json:"running"`
+	StopStage   stopStage     `json:"stop_stage"`
+	Ready       bool          `json:"ready"`
+	Probes      []probeResult `json:"probes,omitempty"`
+	Pid         int           `json:"pid"`
+	RepoHash    string        `json:"repo_hash"`
+	Raleigh     raleighInfo   `json:"raleigh"`
+	Exited      *exitStatus   `json:"exited,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	ErrorKind   failureKind   `json:"error_kind"`
+	LastError   string        `json:"last_error,omitempty"`
+	LastErrKind failureKind   `json:"last_error_kind"`
+	LastErrorAt time.Time     `json:"last_error_at"`
+	Cordoned    bool          `json:"cordoned"`
+	Busy        bool          `json:"busy"`
+	Action      string        `json:"action,omitempty"`
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s TpuStatusUpdate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statusUpdateJson{
+		Id: s.id, Status: s.status, Info: s.info, Installed: s.installed, Cloned: s.cloned, Running: s.running,
+		StopStage: s.stopStage, Ready: s.ready, Probes: s.probes, Pid: s.pid, RepoHash: s.repoHash, Raleigh: s.raleigh,
+		Exited: s.exited, Error: errorString(s.err), ErrorKind: failureOf(s.err), LastError: errorString(s.lastErr),
+		LastErrKind: failureOf(s.lastErr), LastErrorAt: s.lastErrAt,
+		Cordoned: s.cordoned, Busy: s.busy, Action: s.action,
+	})
+}
+
+func (s *TpuStatusUpdate) UnmarshalJSON(data []byte) error {
+	var j statusUpdateJson
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*s = TpuStatusUpdate{
+		id: j.Id, status: j.Status, info: j.Info, installed: j.Installed, cloned: j.Cloned, running: j.Running,
+		stopStage: j.StopStage, ready: j.Ready, probes: j.Probes, pid: j.Pid, repoHash: j.RepoHash, raleigh: j.Raleigh,
+		exited: j.Exited, err: kindError(j.Error, j.ErrorKind), lastErr: kindError(j.LastError, j.LastErrKind), lastErrAt: j.LastErrorAt,
+		cordoned: j.Cordoned, busy: j.Busy, action: j.Action,
+	}
+	return nil
+}
+
+type probeResultJson struct {
+	Name     string    `json:"name"`
+	Kind     probeKind `json:"kind"`
+	Ok       bool      `json:"ok"`
+	Failures int       `json:"failures"`
+	Checked  time.Time `json:"checked"`
+	Message  string    `json:"message,omitempty"`
+}
+
+func (r probeResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(probeResultJson{Name: r.name, Kind: r.kind, Ok: r.ok, Failures: r.failures, Checked: r.checked, Message: r.message})
+}
+
+func (r *probeResult) UnmarshalJSON(data []byte) error {
+	var j probeResultJson
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*r = probeResult{name: j.Name, kind: j.Kind, ok: j.Ok, failures: j.Failures, checked: j.Checked, message: j.Message}
+	return nil
+}
+
+type restartSnapshotJson struct {
+	Policy       restartPolicy `json:"policy"`
+	Restarts     int           `json:"restarts"`
+	CrashLooping bool          `json:"crash_looping"`
+	Held         string        `json:"held,omitempty"`
+	NodeRestarts []int         `json:"node_restarts"`
+	NodeLastExit []string      `json:"node_last_exit"`
+}
+
+func (s restartSnapshot) MarshalJSON() ([]byte, error) {
+	return json.Marshal(restartSnapshotJson{
+		Policy: s.policy, Restarts: s.restarts, CrashLooping: s.crashLooping, Held: s.held,
+		NodeRestarts: s.nodeRestarts, NodeLastExit: s.nodeLastExit,
+	})
+}
+
+func (s *restartSnapshot) UnmarshalJSON(data []byte) error {
+	var j restartSnapshotJson
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*s = restartSnapshot{
+		policy: j.Policy, restarts: j.Restarts, crashLooping: j.CrashLooping, held: j.Held,
+		nodeRestarts: j.NodeRestarts, nodeLastExit: j.NodeLastExit,
+	}
+	return nil
+}
+
+type rankMetricsJson struct {
+	Latest       trainingMetrics `json:"latest"`
+	Updated      time.Time       `json:"updated"`
+	Loss         []float64       `json:"loss"`
+	TokensPerSec []float64       `json:"tokens_per_sec"`
+}
+
+func (r rankMetrics) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rankMetricsJson{Latest: r.latest, Updated: r.updated, Loss: r.loss, TokensPerSec: r.tokensPerSec})
+}
+
+func (r *rankMetrics) UnmarshalJSON(data []byte) error {
+	var j rankMetricsJson
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	*r = rankMetrics{latest: j.Latest, updated: j.Updated, loss: j.Loss, tokensPerSec: j.TokensPerSec}
+	return nil
+}
+
+type logLineJson struct {
+	Seq  uint64 `json:"seq"`
+	Node int    `json:"node"`
+	Text string `json:"text"`
+}
+
+// daemonStatus is the answer to GET /status.
+type daemonStatus struct {
+	Started    time.Time         `json:"started"`
+	Nodes      []TpuStatusUpdate `json:"nodes"`
+	Restarts   restartSnapshot   `json:"restarts"`
+	Stragglers []string          `json:"stragglers"`
+	Compared   []int             `json:"compared"`
+	Budgets    []budgetUsage     `json:"budgets"`
+}
+
+type eventsResponse struct {
+	Events []event `json:"events"`
+	Next   int     `json:"next"`
+}
+
+type logsResponse struct {
+	Lines []logLineJson `json:"lines"`
+	Next  uint64        `json:"next"`
+}
+
+type commandRequest struct {
+	Node   int    `json:"node"`
+	Action string `json:"action"`
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// authMode picks the credentials every gcloud call runs with. They are passed through
+// CLOUDSDK_* variables, so the user's own gcloud config is never changed.
+type authMode string
+
+const (
+	// whatever account gcloud has active
+	authGcloud authMode = "gcloud"
+	// one of the accounts in gcloud auth list
+	authAccount authMode = "account"
+	// a service account key file
+	authKeyFile authMode = "keyFile"
+	// application default credentials, the metadata server on a GCE VM
+	authAdc authMode = "adc"
+	// a service account impersonated with the active account
+	authImpersonate authMode = "impersonate"
+)
+
+type GcloudAuth struct {
+	Account string `json:"account"`
+	Status  string `json:"status"`
+}
+
+func validAuthMode(value string, values map[string]string) error {
+	switch authMode(value) {
+	case authGcloud, authAdc:
+		return nil
+	case authAccount:
+		if values["authAccount"] == "" {
+			return fmt.Errorf("set an account")
+		}
+		return nil
+	case authKeyFile:
+		if values["authKeyFile"] == "" {
+			return fmt.Errorf("set a key file")
+		}
+		return nil
+	case authImpersonate:
+		if values["impersonateServiceAccount"] == "" {
+			return fmt.Errorf("set a service account to impersonate")
+		}
+		return nil
+	}
+	return fmt.Errorf("one of gcloud, account, keyFile, adc, impersonate")
+}
+
+// setupAuth points gcloud at the configured credentials for this process and its children.
+func setupAuth() error {
+	mode := authMode(viper.GetString("authMode"))
+	values := map[string]string{
+		"authAccount":               viper.GetString("authAccount"),
+		"authKeyFile":               viper.GetString("authKeyFile"),
+		"impersonateServiceAccount": viper.GetString("impersonateServiceAccount"),
+	}
+	err := validAuthMode(string(mode), values)
+	if err != nil {
+		return fmt.Errorf("error in authMode %q: %w", mode, err)
+	}
+	switch mode {
+	case authAccount:
+		os.Setenv("CLOUDSDK_CORE_ACCOUNT", values["authAccount"])
+	case authKeyFile:
+		path, err := expandHome(values["authKeyFile"])
+		if err != nil {
+			return err
+		}
+		_, err = readCredentialsFile(path)
+		if err != nil {
+			return err
+		}
+		os.Setenv("CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE", path)
+	case authAdc:
+		path := adcPath()
+		if path == "" {
+			// gcloud falls back to the metadata server on its own
+			return nil
+		}
+		kind, err := readCredentialsFile(path)
+		if err != nil {
+			return err
+		}
+		if kind == "authorized_user" {
+			return fmt.Errorf("application default credentials in %s are a user login, which gcloud can't use as a credential file; use authMode account instead", path)
+		}
+		os.Setenv("CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE", path)
+	case authImpersonate:
+		os.Setenv("CLOUDSDK_AUTH_IMPERSONATE_SERVICE_ACCOUNT", values["impersonateServiceAccount"])
+	}
+	return nil
+}
+
+func expandHome(path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error getting home directory: %w", err)
+		}
+		return filepath.Join(homeDir, rest), nil
+	}
+	return path, nil
+}
+
+// adcPath is the application default credentials file, empty when there is none.
+func adcPath() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	configDir := os.Getenv("CLOUDSDK_CONFIG")
+	if configDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configDir = filepath.Join(homeDir, ".config", "gcloud")
+	}
+	path := filepath.Join(configDir, "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// readCredentialsFile checks that path holds Google credentials and returns their type.
+func readCredentialsFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading credentials: %w", err)
+	}
+	var credentials struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+	}
+	err = json.Unmarshal(data, &credentials)
+	if err != nil {
+		return "", fmt.Errorf("error reading credentials in %s: %w", path, err)
+	}
+	switch credentials.Type {
+	case "service_account", "external_account", "impersonated_service_account", "authorized_user":
+		return credentials.Type, nil
+	}
+	return "", fmt.Errorf("%s is not a credentials file, its type is %q", path, credentials.Type)
+}
+
+func gcloudAccounts(ctx context.Context) ([]GcloudAuth, error) {
+	ctx, cancel := withTimeout(ctx, viper.GetDuration("commandTimeout"))
+	defer cancel()
+	gcloudAuth, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", "auth", "list", "--format", "json"))
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("gcloud is not installed or not on PATH")
+		}
+		return nil, fmt.Errorf("error getting gcloud auth: %w", err)
+	}
+	var authList []GcloudAuth
+	err = json.Unmarshal(gcloudAuth, &authList)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling gcloud auth: %w", err)
+	}
+	return authList, nil
+}
+
+// checkCredentials makes sure the configured credentials are there. Nobody is asked to log in,
+// so this works the same on a headless server.
+func checkCredentials(ctx context.Context) error {
+	mode := authMode(viper.GetString("authMode"))
+	if mode == authKeyFile || mode == authAdc {
+		// setupAuth already read the file, and gcloud auth list doesn't show overrides
+		return nil
+	}
+	accounts, err := gcloudAccounts(ctx)
+	if err != nil {
+		return err
+	}
+	if mode == authAccount {
+		account := viper.GetString("authAccount")
+		for _, auth := range accounts {
+			if auth.Account == account {
+				return nil
+			}
+		}
+		return fmt.Errorf("account %s is not logged in to gcloud, run gcloud auth login %s", account, account)
+	}
+	for _, auth := range accounts {
+		if auth.Status == "ACTIVE" {
+			return nil
+		}
+	}
+	if mode == authImpersonate {
+		return fmt.Errorf("impersonating %s needs an active gcloud account, run gcloud auth login", viper.GetString("impersonateServiceAccount"))
+	}
+	return fmt.Errorf("no active gcloud account, run gcloud auth login or set authMode (keyFile, adc) for a headless machine")
+}
+
+// checkProjectAccess lists the TPUs in the configured zone, which fails unless the credentials
+// can see the project and the TPU API is enabled in it.
+func checkProjectAccess(ctx context.Context, cfg TpuConfig) error {
+	if cfg.project == "" {
+		return fmt.Errorf("no project configured, set project")
+	}
+	ctx, cancel := withTimeout(ctx, cfg.commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "tpus", "tpu-vm", "list", "--project", cfg.project, "--zone", cfg.zone, "--format", "value(name)", "--limit", "1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := runCmd(ctx, "gcloud", "", cmd)
+	if err == nil {
+		return nil
+	}
+	if apiDisabled(stderr.String()) {
+		return fmt.Errorf("the TPU API is not enabled in %s, run gcloud services enable tpu.googleapis.com --project %s", cfg.project, cfg.project)
+	}
+	return classify(fmt.Sprintf("checking access to TPUs in %s/%s", cfg.project, cfg.zone), "gcloud", err, stderr.String())
+}
+
+func apiDisabled(stderr string) bool {
+	return strings.Contains(stderr, "SERVICE_DISABLED") || strings.Contains(stderr, "has not been used in project") || strings.Contains(stderr, "it is disabled")
+}
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// exit codes of the headless commands
+const (
+	exitOk         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitNotRunning = 3
+	// a command run by exec failed on some node, its own exit codes are in the output
+	exitRemoteFailed = 4
+)
+
+const cliUsage = `usage: raleigh [command] [flags]
+
+Without a command, the interactive UI is started.
+
+commands:
+  up        create TPUs and keep the training group running
+  down      stop the training process everywhere (--delete also deletes the VMs)
+  status    print the state of every TPU; exits 3 if the group is not fully running
+  logs      print training logs (--node, --lines, --follow)
+  ssh       open a shell on a TPU, or run a command there: ssh <node> [command...]
+  exec      run a command on every TPU: exec [--node n] <command...>; exits 4 if it failed anywhere
+  sync      push the local repo to every TPU and run the install command
+  restart   stop the training process everywhere and start a new group
+  config    config get [key] | config set <key> <value>
+  daemon    keep watching the TPUs in the background; the UI and the commands above attach to it
+  events    print the daemon's event timeline (--follow)
+  doctor    check binaries, ssh keys, the repo, the config, the project, quota and firewall rules
+
+every command takes --json for machine-readable output
+`
+
+// cliOutput prints either plain lines or one JSON object per line.
+type cliOutput struct {
+	json  bool
+	mutex sync.Mutex
+}
+
+func (o *cliOutput) print(value any, format string, a ...any) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.json {
+		valueJson, err := json.Marshal(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error marshalling output: %v\n", err)
+			return
+		}
+		fmt.Println(string(valueJson))
+		return
+	}
+	fmt.Printf(format+"\n", a...)
+}
+
+func (o *cliOutput) error(err error) {
+	result := map[string]string{"error": err.Error()}
+	if kind := failureOf(err); kind != failureUnknown {
+		result["error_kind"] = kind.String()
+		result["hint"] = kind.Hint()
+	}
+	o.print(result, "error: %s", withHint(err))
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print JSON, one object per line")
+	return flags, asJson
+}
+
+func runCli(args []string) int {
+	command, args := args[0], args[1:]
+	switch command {
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return exitOk
+	case "config":
+		return cliConfig(args)
+	}
+
+	commands := map[string]func(context.Context, TpuConfig, []string) int{
+		"up":      cliUp,
+		"down":    cliDown,
+		"status":  cliStatus,
+		"logs":    cliLogs,
+		"ssh":     cliSsh,
+		"exec":    cliExec,
+		"sync":    cliSync,
+		"restart": cliRestart,
+		"daemon":  cliDaemon,
+		"events":  cliEvents,
+		"doctor":  cliDoctor,
+	}
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, cliUsage)
+		return exitUsage
+	}
+	logName := "cli"
+	if command == "daemon" {
+		logName = "daemon"
+	}
+	// the first ctrl+c cancels whatever is running, watchers and remote commands included
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := setupLogging(logName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	err = setupTracing(logName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	err = setupAudit(logName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	setupLimits()
+	defer flushTraces()
+	cfg := GetConfig()
+	// the doctor reports on the credentials, the config and the project itself
+	if command != "doctor" {
+		cfg, err = cliPreconditions(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	code := run(ctx, cfg, args)
+	stop()
+	// commands started in the background are killed now, give them a moment to go
+	waitCommands(2 * commandWaitDelay)
+	return code
+}
+
+// cliPreconditions makes sure the credentials, the config and the project work before a command runs.
+func cliPreconditions(ctx context.Context) (TpuConfig, error) {
+	err := setupAuth()
+	if err == nil {
+		err = checkCredentials(ctx)
+	}
+	if err != nil {
+		return TpuConfig{}, err
+	}
+	cfg, err := GetRunConfig()
+	if err != nil {
+		return cfg, err
+	}
+	err = setupSsh(ctx, cfg)
+	if err != nil {
+		return cfg, errors.New(withHint(err))
+	}
+	// a running daemon already checked, and commands only talk to it
+	if dialDaemon() == nil {
+		err = checkProjectAccess(ctx, cfg)
+		if err != nil {
+			return cfg, errors.New(withHint(err))
+		}
+	}
+	return cfg, nil
+}
+
+func tpuName(cfg TpuConfig, id int) string {
+	return fmt.Sprintf("%s%d", cfg.tpuPrefix, id)
+}
+
+// forEachNode runs fn on every node at once and returns the first error, if any.
+func forEachNode(cfg TpuConfig, fn func(id int) error) error {
+	errs := make([]error, cfg.numTpus)
+	wg := sync.WaitGroup{}
+	for id := range cfg.numTpus {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[id] = fn(id)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+type nodeStatusJson struct {
+	Node      int    `json:"node"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	Health    string `json:"health,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Installed bool   `json:"installed"`
+	Cloned    bool   `json:"cloned"`
+	Running   bool   `json:"running"`
+	Pid       int    `json:"pid,omitempty"`
+	RepoHash  string `json:"repo_hash,omitempty"`
+	GroupId   int    `json:"group_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorKind string `json:"error_kind,omitempty"`
+	Hint      string `json:"hint,omitempty"`
+}
+
+func (s *nodeStatusJson) setError(err error) {
+	if err == nil {
+		return
+	}
+	s.Error = err.Error()
+	if kind := failureOf(err); kind != failureUnknown {
+		s.ErrorKind = kind.String()
+		s.Hint = kind.Hint()
+	}
+}
+
+func cliStatus(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("status")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	statuses := make([]nodeStatusJson, cfg.numTpus)
+	if client := dialDaemon(); client != nil {
+		// the daemon already knows, no need to ssh into every node
+		var fleet daemonStatus
+		err := client.get("/status", &fleet)
+		if err != nil {
+			out.error(err)
+			return exitError
+		}
+		statuses = make([]nodeStatusJson, len(fleet.Nodes))
+		for id, status := range fleet.Nodes {
+			statuses[id] = nodeStatusJson{
+				Node: id, Name: tpuName(cfg, id), State: status.status.String(), Health: status.info.Health, IP: status.info.IP,
+				Installed: status.installed, Cloned: status.cloned, Running: status.running, Pid: max(status.pid, 0),
+				RepoHash: status.repoHash, GroupId: status.raleigh.GroupId,
+			}
+			statuses[id].setError(status.lastErr)
+		}
+	} else {
+		collectStatuses(ctx, cfg, statuses)
+	}
+	return printStatuses(cfg, out, statuses)
+}
+
+// collectStatuses asks every node directly, when there is no daemon to ask.
+func collectStatuses(ctx context.Context, cfg TpuConfig, statuses []nodeStatusJson) {
+	forEachNode(cfg, func(id int) error {
+		status := nodeStatusJson{Node: id, Name: tpuName(cfg, id)}
+		installer, err := NewTpuInstaller(ctx, cfg, status.Name)
+		if err != nil {
+			status.State = tpuStatusError.String()
+			status.setError(err)
+			statuses[id] = status
+			return err
+		}
+		info := installer.tpuController.latestInfo
+		status.State = installer.tpuController.latestStatus.String()
+		status.Health = info.Health
+		status.IP = info.IP
+		status.Installed = installer.basicsInstalled
+		status.Cloned = installer.repoCloned
+		status.Running = installer.runningPid != -1
+		if status.Running {
+			status.Pid = installer.runningPid
+		}
+		status.RepoHash = installer.repoClonedHash
+		status.GroupId = installer.raleighInfo.GroupId
+		statuses[id] = status
+		return nil
+	})
+}
+
+func printStatuses(cfg TpuConfig, out *cliOutput, statuses []nodeStatusJson) int {
+	numRunning := 0
+	for _, status := range statuses {
+		if status.Running {
+			numRunning++
+		}
+		line := fmt.Sprintf("%s\t%s\tinstalled=%s cloned=%s running=%s pid=%d group=%d", status.Name, status.State, yesNo(status.Installed), yesNo(status.Cloned), yesNo(status.Running), status.Pid, status.GroupId)
+		if status.Error != "" {
+			line += "\terror: " + status.Error
+		}
+		if status.Hint != "" {
+			line += "\thint: " + status.Hint
+		}
+		out.print(status, "%s", line)
+	}
+	if numRunning < cfg.numTpusActive {
+		return exitNotRunning
+	}
+	return exitOk
+}
+
+func cliStop(ctx context.Context, cfg TpuConfig, out *cliOutput, deleteVms bool) error {
+	return forEachNode(cfg, func(id int) error {
+		name := tpuName(cfg, id)
+		installer, err := NewTpuInstaller(ctx, cfg, name)
+		if err != nil {
+			out.print(map[string]any{"node": id, "error": err.Error()}, "%s: %v", name, err)
+			return err
+		}
+		if installer.tpuController.latestStatus == tpuStatusRunning {
+			err = installer.stopIfRunning(ctx, func(string) {}, func(stage stopStage) {
+				out.print(map[string]any{"node": id, "stop": stage.describe(cfg.stopSignal)}, "%s: %s", name, stage.describe(cfg.stopSignal))
+			})
+			if err != nil {
+				out.print(map[string]any{"node": id, "error": err.Error()}, "%s: %v", name, err)
+				return err
+			}
+		}
+		if deleteVms && installer.tpuController.latestStatus != tpuStatusNonexistent {
+			out.print(map[string]any{"node": id, "action": "delete"}, "%s: deleting VM", name)
+			err = installer.tpuController.delete(ctx)
+			if err != nil {
+				err = fmt.Errorf("error deleting %s: %w", name, err)
+				out.print(map[string]any{"node": id, "error": err.Error()}, "%s: %v", name, err)
+				return err
+			}
+		}
+		out.print(map[string]any{"node": id, "done": true}, "%s: stopped", name)
+		return nil
+	})
+}
+
+// superviseHeadless prints the watcher's events. With untilRunning, it returns once a group other
+// than skipGroup is up and leaves the training running on the TPUs.
+func superviseHeadless(ctx context.Context, watcher *TpuWatcher, out *cliOutput, untilRunning bool, skipGroup int, timeout time.Duration) int {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	printed := 0
+	for {
+		select {
+		case <-watcher.updates:
+		case <-ctx.Done():
+			out.print(map[string]string{"exit": "interrupted"}, "interrupted; processes on the TPUs keep running")
+			return exitOk
+		case <-deadline:
+			out.print(map[string]string{"exit": "timeout"}, "timed out after %s", timeout)
+			return exitNotRunning
+		}
+		var events []event
+		events, printed = watcher.events.Since(printed)
+		for _, e := range events {
+			out.print(e, "%s", formatEvent(e, watcher.cfg))
+		}
+		if untilRunning && runningGroup(watcher) > 0 && runningGroup(watcher) != skipGroup {
+			return exitOk
+		}
+	}
+}
+
+// runningGroup is the id of the group if every active rank is running in it, 0 otherwise.
+func runningGroup(watcher *TpuWatcher) int {
+	groups := map[int]int{}
+	for _, status := range watcher.Status().Nodes {
+		if status.running && status.raleigh.IsReal() {
+			groups[status.raleigh.GroupId]++
+		}
+	}
+	for groupId, numRunning := range groups {
+		if numRunning >= watcher.cfg.numTpusActive {
+			return groupId
+		}
+	}
+	return 0
+}
+
+// headlessWatcher attaches to the daemon if one is running, and watches the TPUs itself otherwise.
+func headlessWatcher(ctx context.Context, cfg TpuConfig) (*TpuWatcher, error) {
+	if client := dialDaemon(); client != nil {
+		watcher, err := attachWatcher(ctx, client)
+		if err != nil {
+			return nil, fmt.Errorf("error attaching to daemon: %w", err)
+		}
+		return watcher, nil
+	}
+	return startWatcher(ctx, cfg)
+}
+
+// commandAll sends an action to every node through the daemon and waits until they are done.
+func commandAll(ctx context.Context, watcher *TpuWatcher, out *cliOutput, action nodeAction) int {
+	for id := range watcher.cfg.numTpus {
+		err := watcher.remote.client.Command(id, action)
+		if err != nil {
+			out.error(err)
+			return exitError
+		}
+	}
+	reported := make([]string, watcher.cfg.numTpus)
+	// the first update may have been fetched before the commands were sent
+	<-watcher.updates
+	for range watcher.updates {
+		busy := false
+		for id, status := range watcher.Status().Nodes {
+			busy = busy || status.busy
+			if status.action != reported[id] {
+				reported[id] = status.action
+				out.print(map[string]any{"node": id, "action": status.action}, "%s: %s", tpuName(watcher.cfg, id), status.action)
+			}
+		}
+		if !busy {
+			return exitOk
+		}
+	}
+	// the mirror stops updating once ctx is done
+	out.print(map[string]string{"exit": "interrupted"}, "interrupted; the daemon carries on with the actions")
+	return exitOk
+}
+
+func cliUp(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("up")
+	untilRunning := flags.Bool("until-running", false, "exit once the group is running instead of supervising it")
+	timeout := flags.Duration("timeout", 0, "give up after this long (exit code 3)")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	watcher, err := headlessWatcher(ctx, cfg)
+	if err != nil {
+		out.error(err)
+		return exitError
+	}
+	if watcher.remote != nil {
+		// nodes taken down through the daemon are cordoned
+		for id := range watcher.cfg.numTpus {
+			watcher.Command(id, actionUncordon)
+		}
+	}
+	return superviseHeadless(ctx, watcher, out, *untilRunning, 0, *timeout)
+}
+
+func cliDown(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("down")
+	deleteVms := flags.Bool("delete", false, "also delete the VMs")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	if client := dialDaemon(); client != nil {
+		// the daemon would restart anything we stop behind its back, so cordon instead
+		watcher, err := attachWatcher(ctx, client)
+		if err != nil {
+			out.error(err)
+			return exitError
+		}
+		action := actionCordon
+		if *deleteVms {
+			action = actionDelete
+		}
+		return commandAll(ctx, watcher, out, action)
+	}
+	if cliStop(ctx, cfg, out, *deleteVms) != nil {
+		return exitError
+	}
+	return exitOk
+}
+
+func cliRestart(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("restart")
+	timeout := flags.Duration("timeout", 0, "give up after this long (exit code 3)")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	if client := dialDaemon(); client != nil {
+		watcher, err := attachWatcher(ctx, client)
+		if err != nil {
+			out.error(err)
+			return exitError
+		}
+		previous := runningGroup(watcher)
+		code := commandAll(ctx, watcher, out, actionRestart)
+		if code != exitOk {
+			return code
+		}
+		return superviseHeadless(ctx, watcher, out, true, previous, *timeout)
+	}
+	if cliStop(ctx, cfg, out, false) != nil {
+		return exitError
+	}
+	watcher, err := startWatcher(ctx, cfg)
+	if err != nil {
+		out.error(err)
+		return exitError
+	}
+	return superviseHeadless(ctx, watcher, out, true, 0, *timeout)
+}
+
+func cliDaemon(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, _ := newFlagSet("daemon")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	socketPath, err := daemonSocketPath()
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "listening on %s\n", socketPath)
+		err = runDaemon(ctx, cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOk
+}
+
+func cliEvents(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("events")
+	follow := flags.Bool("follow", false, "keep printing new events")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	client := dialDaemon()
+	if client == nil {
+		out.error(fmt.Errorf("no daemon is running, start one with raleigh daemon"))
+		return exitNotRunning
+	}
+	err := client.Events(ctx, *follow, func(e event) {
+		out.print(e, "%s", formatEvent(e, cfg))
+	})
+	if err != nil {
+		out.error(err)
+		return exitError
+	}
+	return exitOk
+}
+
+func cliSync(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("sync")
+	force := flags.Bool("force", false, "sync even if the remote repo hash matches")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	err := forEachNode(cfg, func(id int) error {
+		name := tpuName(cfg, id)
+		installer, err := NewTpuInstaller(ctx, cfg, name)
+		if err == nil && installer.tpuController.latestStatus != tpuStatusRunning {
+			err = fmt.Errorf("tpu is not running")
+		}
+		if err == nil && (*force || !installer.repoCloned) {
+			out.print(map[string]any{"node": id, "action": "sync"}, "%s: syncing", name)
+			err = installer.CloneRepo(ctx)
+		}
+		if err != nil {
+			out.print(map[string]any{"node": id, "error": err.Error()}, "%s: %v", name, err)
+			return err
+		}
+		out.print(map[string]any{"node": id, "repo_hash": installer.repoClonedHash}, "%s: up to date (%s)", name, shortHash(installer.repoClonedHash))
+		return nil
+	})
+	if err != nil {
+		return exitError
+	}
+	return exitOk
+}
+
+func parseNode(cfg TpuConfig, s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 0 || id >= cfg.numTpus {
+		return 0, fmt.Errorf("node must be a number from 0 to %d", cfg.numTpus-1)
+	}
+	return id, nil
+}
+
+func cliLogs(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("logs")
+	node := flags.Int("node", -1, "only this node")
+	lines := flags.Int("lines", 100, "lines of history to print")
+	follow := flags.Bool("follow", false, "keep printing new lines")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	if replay != nil {
+		out.error(fmt.Errorf("log streams are not recorded, so they can't be replayed"))
+		return exitError
+	}
+	command := fmt.Sprintf("tail -n %d ~/.raleigh/nohup.log", *lines)
+	if *follow {
+		command = fmt.Sprintf("tail -n %d -F ~/.raleigh/nohup.log", *lines)
+	}
+	err := forEachNode(cfg, func(id int) error {
+		if *node >= 0 && id != *node {
+			return nil
+		}
+		cmd := NewTpuController(cfg, tpuName(cfg, id)).ssh(ctx, cfg.username, command)
+		killProcessGroup(cmd)
+		cmd.WaitDelay = commandWaitDelay
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("error getting stdout pipe: %w", err)
+		}
+		err = cmd.Start()
+		if err != nil {
+			return fmt.Errorf("error starting tail on %s: %w", tpuName(cfg, id), err)
+		}
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if *node >= 0 {
+				out.print(map[string]any{"node": id, "line": scanner.Text()}, "%s", scanner.Text())
+			} else {
+				out.print(map[string]any{"node": id, "line": scanner.Text()}, "[%s] %s", tpuName(cfg, id), scanner.Text())
+			}
+		}
+		err = cmd.Wait()
+		if ctx.Err() != nil {
+			// interrupted, which is how --follow ends
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading logs of %s: %w", tpuName(cfg, id), err)
+		}
+		return nil
+	})
+	if err != nil {
+		out.error(err)
+		return exitError
+	}
+	return exitOk
+}
+
+func cliSsh(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, _ := newFlagSet("ssh")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: raleigh ssh <node> [command...]")
+		return exitUsage
+	}
+	id, err := parseNode(cfg, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if replay != nil && flags.NArg() == 1 {
+		fmt.Fprintln(os.Stderr, "interactive ssh is not available while replaying")
+		return exitError
+	}
+	controller := NewTpuController(cfg, tpuName(cfg, id))
+	cmd := controller.interactiveSsh(ctx, cfg.username)
+	if flags.NArg() > 1 {
+		cmd = controller.ssh(ctx, cfg.username, strings.Join(flags.Args()[1:], " "))
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if flags.NArg() > 1 {
+		err = runCmd(ctx, "ssh", controller.id, cmd)
+	} else {
+		// interactive sessions aren't recorded
+		err = cmd.Run()
+	}
+	if code := exitCode(err); code > 0 {
+		return code
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOk
+}
+
+type execResultJson struct {
+	Node     int     `json:"node"`
+	Name     string  `json:"name"`
+	ExitCode int     `json:"exit_code"`
+	Output   string  `json:"output"`
+	Error    string  `json:"error,omitempty"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// cliExec exits 1 if ssh itself failed on any node, otherwise 4 if the command failed on any node.
+// The remote exit codes would collide with our own, they are printed per node instead.
+func cliExec(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("exec")
+	node := flags.Int("node", -1, "only this node")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: raleigh exec [--node n] <command...>")
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	command := strings.Join(flags.Args(), " ")
+	results := make([]*execResult, cfg.numTpus)
+	forEachNode(cfg, func(id int) error {
+		if *node < 0 || id == *node {
+			result := execOnNode(ctx, cfg, id, command)
+			results[id] = &result
+		}
+		return nil
+	})
+
+	code := exitOk
+	for id, result := range results {
+		if result == nil {
+			continue
+		}
+		resultJson := execResultJson{Node: id, Name: tpuName(cfg, id), ExitCode: result.exitCode, Output: result.output, Seconds: result.duration.Seconds()}
+		if result.err != nil {
+			resultJson.Error = result.err.Error()
+		}
+		if out.json {
+			out.print(resultJson, "")
+		} else {
+			status := fmt.Sprintf("exit %d", result.exitCode)
+			if result.err != nil {
+				status = result.err.Error()
+			}
+			out.print(nil, "[%s] %s", resultJson.Name, status)
+			for _, line := range strings.Split(strings.TrimRight(result.output, "\n"), "\n") {
+				out.print(nil, "[%s] %s", resultJson.Name, line)
+			}
+		}
+		if result.err != nil {
+			code = exitError
+		} else if code == exitOk && result.exitCode != 0 {
+			code = exitRemoteFailed
+		}
+	}
+	return code
+}
+
+func cliConfig(args []string) int {
+	flags, asJson := newFlagSet("config")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	args = flags.Args()
+	switch {
+	case len(args) == 1 && args[0] == "get":
+		if out.json {
+			out.print(viper.AllSettings(), "")
+			return exitOk
+		}
+		keys := viper.AllKeys()
+		sort.Strings(keys)
+		for _, key := range keys {
+			out.print(nil, "%s=%v", key, viper.Get(key))
+		}
+		return exitOk
+	case len(args) == 2 && args[0] == "get":
+		if !viper.IsSet(args[1]) {
+			fmt.Fprintf(os.Stderr, "%s is not set\n", args[1])
+			return exitError
+		}
+		out.print(map[string]any{args[1]: viper.Get(args[1])}, "%v", viper.Get(args[1]))
+		return exitOk
+	case len(args) == 3 && args[0] == "set":
+		err := setConfigValue(args[1], args[2])
+		if err != nil {
+			out.error(err)
+			return exitError
+		}
+		out.print(map[string]any{args[1]: viper.Get(args[1])}, "%s=%v", args[1], viper.Get(args[1]))
+		return exitOk
+	}
+	fmt.Fprintln(os.Stderr, "usage: raleigh config get [key] | raleigh config set <key> <value>")
+	return exitUsage
+}
+
+// setConfigValue validates a value like the settings editor does and writes the config.
+func setConfigValue(key, value string) error {
+	values := map[string]string{}
+	for _, field := range settingFields {
+		values[field.key] = viper.GetString(field.key)
+	}
+	values[key] = value
+	for _, field := range settingFields {
+		if !strings.EqualFold(field.key, key) {
+			continue
+		}
+		key = field.key
+		values[key] = value
+		err := field.check(value, values)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if field.kind == settingInt {
+			n, _ := strconv.Atoi(value)
+			viper.Set(key, n)
+		} else {
+			viper.Set(key, value)
+		}
+		return writeConfig()
+	}
+	// picked from lists in the UI, so they have no settings field
+	for _, known := range []string{"spot", "preemptible", "project", "instanceType", "region"} {
+		if !strings.EqualFold(known, key) {
+			continue
+		}
+		if known == "spot" || known == "preemptible" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: must be true or false", known)
+			}
+			viper.Set(known, b)
+		} else {
+			viper.Set(known, value)
+		}
+		return writeConfig()
+	}
+	return fmt.Errorf("unknown setting %s", key)
+}
+
+func writeConfig() error {
+	err := viper.WriteConfig()
+	if err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	return nil
+}
@@ -40,12 +40,13 @@ func upToDate(fn func() tea.Model) tea.Model {
 }
 
 type simpleListItem struct {
-	name string
-	id   string
+	name        string
+	id          string
+	description string
 }
 
 func (i simpleListItem) Title() string       { return i.name }
-func (i simpleListItem) Description() string { return "" }
+func (i simpleListItem) Description() string { return i.description }
 func (i simpleListItem) FilterValue() string { return i.id }
 
 func setDefault(items []simpleListItem, defaultId string) []list.Item {
@@ -76,6 +77,9 @@ func (m simpleListModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.list.SetWidth(msg.Width)
 		m.list.SetHeight(msg.Height - 1)
 	case tea.KeyMsg:
+		if m.list.FilterState() == list.Filtering {
+			break
+		}
 		switch msg.String() {
 		case "enter":
 			if m.list.SelectedItem() != nil {
@@ -116,6 +120,7 @@ type simpleSpinnerModel struct {
 	spinner     spinner.Model
 	message     string
 	height      int
+	err         error
 }
 
 func (m simpleSpinnerModel) Init() tea.Cmd {
@@ -132,6 +137,7 @@ func (m simpleSpinnerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case gotNextModel:
 		return msg, msg.Init()
 	case spinnerError:
+		m.err = msg
 		return m, tea.Quit
 	case tea.WindowSizeMsg:
 		m.height = msg.Height
@@ -144,6 +150,9 @@ func (m simpleSpinnerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m simpleSpinnerModel) View() string {
+	if m.err != nil {
+		return quitTextStyle.Render(m.err.Error())
+	}
 	builder := strings.Builder{}
 	totalHeight := m.height - 1
 	if totalHeight < 0 {
@@ -184,7 +193,9 @@ func selectProject(m tea.Model) tea.Model {
 	project := viper.GetString("project")
 
 	var modelGetter tea.Cmd = func() tea.Msg {
-		projects, err := exec.Command("gcloud", "projects", "list", "--format", "json").Output()
+		ctx, cancel := localTimeout()
+		defer cancel()
+		projects, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", "projects", "list", "--format", "json"))
 
 		if err != nil {
 			return spinnerError{err: fmt.Errorf("failed to get projects: %w", err)}
@@ -245,19 +256,6 @@ func simpleSelectorBool(configKey string) func(m tea.Model) tea.Model {
 	}
 }
 
-var selectRegion = simpleSelectorConstant("region", "Region", []simpleListItem{
-	{name: "us-central2-b", id: "us-central2-b"},
-	{name: "us-central1-f", id: "us-central1-f"},
-	{name: "europe-west4-a", id: "europe-west4-a"},
-	{name: "us-east1-d", id: "us-east1-d"},
-})
-
-var selectInstanceType = simpleSelectorConstant("instanceType", "Instance Type", []simpleListItem{
-	{name: "v2-8", id: "v2-8"},
-	{name: "v3-8", id: "v3-8"},
-	{name: "v4-8", id: "v4-8"},
-})
-
 type settingChoice struct {
 	id   string
 	name string
@@ -273,6 +271,7 @@ func settings(m tea.Model) tea.Model {
 		{id: "instanceType", name: "Instance Type", fn: selectInstanceType},
 		{id: "preemptible", name: "Preemptible", fn: simpleSelectorBool("preemptible")},
 		{id: "spot", name: "Spot", fn: simpleSelectorBool("spot")},
+		{id: "all", name: "All settings", fn: editSettings},
 	}
 	items := []list.Item{
 		simpleListItem{name: "Back", id: "back"},
@@ -298,19 +297,44 @@ func settings(m tea.Model) tea.Model {
 
 func GetConfig() TpuConfig {
 	return TpuConfig{
-		project:          viper.GetString("project"),
-		zone:             viper.GetString("region"),
-		instanceType:     viper.GetString("instanceType"),
-		numTpus:          viper.GetInt("numTpus"),
-		username:         viper.GetString("username"),
-		repoPath:         viper.GetString("repoPath"),
-		remoteRepoPath:   viper.GetString("remoteRepoPath"),
-		installCommand:   viper.GetString("installCommand"),
-		tpuPrefix:        viper.GetString("tpuPrefix"),
-		installerVersion: viper.GetString("installerVersion"),
-		runCommand:       viper.GetString("runCommand"),
-		spot:             viper.GetBool("spot"),
-		preemptible:      viper.GetBool("preemptible"),
-		numTpusActive:    viper.GetInt("numTpusActive"),
+		project:           viper.GetString("project"),
+		zone:              viper.GetString("region"),
+		instanceType:      viper.GetString("instanceType"),
+		numTpus:           viper.GetInt("numTpus"),
+		username:          viper.GetString("username"),
+		repoPath:          viper.GetString("repoPath"),
+		remoteRepoPath:    viper.GetString("remoteRepoPath"),
+		installCommand:    viper.GetString("installCommand"),
+		tpuPrefix:         viper.GetString("tpuPrefix"),
+		installerVersion:  viper.GetString("installerVersion"),
+		runCommand:        viper.GetString("runCommand"),
+		spot:              viper.GetBool("spot"),
+		preemptible:       viper.GetBool("preemptible"),
+		numTpusActive:     viper.GetInt("numTpusActive"),
+		stopSignal:        normalizeSignal(viper.GetString("stopSignal")),
+		stopGracePeriod:   viper.GetDuration("stopGracePeriod"),
+		stopTimeout:       viper.GetDuration("stopTimeout"),
+		restartPolicy:     restartPolicyFromString(viper.GetString("restartPolicy")),
+		restartBackoff:    viper.GetDuration("restartBackoff"),
+		restartBackoffMax: viper.GetDuration("restartBackoffMax"),
+		maxRestarts:       viper.GetInt("maxRestarts"),
+		restartWindow:     viper.GetDuration("restartWindow"),
+		hangTimeout:       viper.GetDuration("hangTimeout"),
+		stragglerSteps:    viper.GetInt("stragglerSteps"),
+		metricsAddr:       viper.GetString("metricsAddr"),
+		commandTimeout:    viper.GetDuration("commandTimeout"),
+		provisionTimeout:  viper.GetDuration("provisionTimeout"),
+		installTimeout:    viper.GetDuration("installTimeout"),
+	}
+}
+
+// GetRunConfig is GetConfig plus the parts of the config that can be invalid.
+func GetRunConfig() (TpuConfig, error) {
+	cfg := GetConfig()
+	probes, err := getProbeConfigs()
+	if err != nil {
+		return cfg, err
 	}
+	cfg.probes = probes
+	return cfg, nil
 }
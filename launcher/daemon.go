@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func daemonSocketPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".raleigh", "daemon.sock"), nil
+}
+
+// Status is a consistent copy of everything the watcher knows about the nodes.
+func (w *TpuWatcher) Status() daemonStatus {
+	if w.remote != nil {
+		return w.remote.latest()
+	}
+	nodes := make([]TpuStatusUpdate, len(w.statuses))
+	for i := range w.statuses {
+		status := &w.statuses[i]
+		status.mutex.Lock()
+		nodes[i] = status.status
+		status.mutex.Unlock()
+		// commands show up right away, not on the node's next iteration
+		nodes[i].cordoned, nodes[i].busy, nodes[i].action = w.controls[i].state()
+	}
+	return daemonStatus{
+		Started:    w.started,
+		Nodes:      nodes,
+		Restarts:   w.restarts.Snapshot(),
+		Stragglers: w.watchdog.Stragglers(),
+		Compared:   w.watchdog.Compared(),
+		Budgets:    limits.Usage(),
+	}
+}
+
+func (w *TpuWatcher) TrainingMetrics() []rankMetrics {
+	if w.remote != nil {
+		return w.remote.latestMetrics()
+	}
+	return w.metrics.Snapshot()
+}
+
+func nodeActionFromString(s string) (nodeAction, bool) {
+	for action := actionRestart; action <= actionUncordon; action++ {
+		if action.String() == s {
+			return action, true
+		}
+	}
+	return actionNone, false
+}
+
+func writeJson(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Warn("error writing response", "err", err)
+	}
+}
+
+func queryInt(r *http.Request, key string) int {
+	n, _ := strconv.Atoi(r.URL.Query().Get(key))
+	return n
+}
+
+// daemonHandler is the control API. It is only reachable through a socket only the user can open.
+func daemonHandler(watcher *TpuWatcher) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, viper.AllSettings())
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, watcher.Status())
+	})
+	mux.Handle("GET /metrics", metricsHandler(watcher))
+	mux.HandleFunc("GET /training", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, watcher.TrainingMetrics())
+	})
+	mux.HandleFunc("GET /events", func(w http.ResponseWriter, r *http.Request) {
+		since := queryInt(r, "since")
+		if r.URL.Query().Get("follow") != "1" {
+			events, next := watcher.events.Since(since)
+			writeJson(w, eventsResponse{Events: events, Next: next})
+			return
+		}
+		// one event per line until the client hangs up
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		for {
+			var events []event
+			events, since = watcher.events.Since(since)
+			for _, e := range events {
+				if encoder.Encode(e) != nil {
+					return
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	})
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+		since := uint64(queryInt(r, "since"))
+		lines := watcher.logs.Interleaved()
+		if len(lines) > 0 && since > lines[len(lines)-1].seq {
+			// the client saw a previous daemon
+			since = 0
+		}
+		response := logsResponse{Lines: []logLineJson{}, Next: since}
+		for _, line := range lines {
+			if line.seq <= since {
+				continue
+			}
+			response.Lines = append(response.Lines, logLineJson{Seq: line.seq, Node: line.node, Text: line.text})
+			response.Next = line.seq
+		}
+		writeJson(w, response)
+	})
+	mux.HandleFunc("POST /command", func(w http.ResponseWriter, r *http.Request) {
+		var request commandRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error decoding command: %v", err), http.StatusBadRequest)
+			return
+		}
+		action, ok := nodeActionFromString(request.Action)
+		if !ok || request.Node < 0 || request.Node >= watcher.cfg.numTpus {
+			http.Error(w, fmt.Sprintf("unknown action %q or node %d", request.Action, request.Node), http.StatusBadRequest)
+			return
+		}
+		watcher.Command(request.Node, action)
+		writeJson(w, map[string]bool{"ok": true})
+	})
+	return mux
+}
+
+// runDaemon keeps the watcher going without a terminal until ctx is done.
+func runDaemon(ctx context.Context, cfg TpuConfig) error {
+	socketPath, err := daemonSocketPath()
+	if err != nil {
+		return err
+	}
+	if dialDaemon() != nil {
+		return fmt.Errorf("a daemon is already listening on %s", socketPath)
+	}
+	// left over from a daemon that didn't shut down cleanly
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", socketPath, err)
+	}
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("error restricting %s: %w", socketPath, err)
+	}
+
+	watcher, err := startWatcher(ctx, cfg)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		// nobody renders the updates here, clients read the statuses instead
+		for range watcher.updates {
+		}
+	}()
+	server := &http.Server{Handler: daemonHandler(watcher)}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	err = server.Serve(listener)
+	os.Remove(socketPath)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return fmt.Errorf("error serving control api: %w", err)
+}
+
+type daemonClient struct {
+	http http.Client
+}
+
+// dialDaemon returns a client if a daemon is listening, nil otherwise.
+func dialDaemon() *daemonClient {
+	// a replay must not touch the real fleet
+	if replay != nil {
+		return nil
+	}
+	socketPath, err := daemonSocketPath()
+	if err != nil {
+		return nil
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return &daemonClient{http: http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}}
+}
+
+func (c *daemonClient) do(method string, path string, body any, out any) error {
+	var requestBody bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&requestBody).Encode(body)
+		if err != nil {
+			return fmt.Errorf("error encoding request: %w", err)
+		}
+	}
+	request, err := http.NewRequest(method, "http://raleigh"+path, &requestBody)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("error talking to daemon: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message := bytes.Buffer{}
+		message.ReadFrom(response.Body)
+		return fmt.Errorf("daemon: %s", bytes.TrimSpace(message.Bytes()))
+	}
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(response.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("error decoding daemon response: %w", err)
+	}
+	return nil
+}
+
+func (c *daemonClient) get(path string, out any) error {
+	return c.do(http.MethodGet, path, nil, out)
+}
+
+func (c *daemonClient) Command(id int, action nodeAction) error {
+	return c.do(http.MethodPost, "/command", commandRequest{Node: id, Action: action.String()}, nil)
+}
+
+// Events calls fn with every event the daemon has, and with new ones as they happen if follow is set.
+func (c *daemonClient) Events(ctx context.Context, follow bool, fn func(event)) error {
+	if !follow {
+		var events eventsResponse
+		err := c.get("/events", &events)
+		if err != nil {
+			return err
+		}
+		for _, e := range events.Events {
+			fn(e)
+		}
+		return nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://raleigh/events?follow=1", nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("error talking to daemon: %w", err)
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var e event
+		err := decoder.Decode(&e)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading event stream: %w", err)
+		}
+		fn(e)
+	}
+}
+
+// daemonMirror keeps a local copy of a daemon's state so the TUI and the CLI can use an
+// attached TpuWatcher exactly like one that watches the TPUs itself.
+type daemonMirror struct {
+	client  *daemonClient
+	mutex   sync.Mutex
+	status  daemonStatus
+	metrics []rankMetrics
+}
+
+func (m *daemonMirror) latest() daemonStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+func (m *daemonMirror) latestMetrics() []rankMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.metrics
+}
+
+// attachWatcher connects to the daemon. The daemon's config is used so both sides agree on the nodes.
+// The mirror stops polling and closes updates once ctx is done.
+func attachWatcher(ctx context.Context, client *daemonClient) (*TpuWatcher, error) {
+	var settings map[string]any
+	err := client.get("/config", &settings)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+	cfg, err := GetRunConfig()
+	if err != nil {
+		return nil, err
+	}
+	mirror := &daemonMirror{client: client}
+	err = mirror.refreshStatus()
+	if err != nil {
+		return nil, err
+	}
+	metrics := newMetricsStore(cfg.numTpus)
+	watcher := &TpuWatcher{
+		cfg:      cfg,
+		updates:  make(chan TpuStatusUpdate),
+		statuses: make([]TpuCurrentStatus, cfg.numTpus),
+		metrics:  metrics,
+		logs:     newLogHub(cfg, metrics),
+		events:   newEventLog(),
+		remote:   mirror,
+		started:  mirror.status.Started,
+	}
+	watcher.events.mirror = true
+	mirror.copyStatuses(watcher)
+	go mirror.poll(ctx, watcher)
+	return watcher, nil
+}
+
+func (m *daemonMirror) refreshStatus() error {
+	var status daemonStatus
+	err := m.client.get("/status", &status)
+	if err != nil {
+		return err
+	}
+	var metrics []rankMetrics
+	err = m.client.get("/training", &metrics)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.status = status
+	m.metrics = metrics
+	return nil
+}
+
+func (m *daemonMirror) copyStatuses(watcher *TpuWatcher) {
+	status := m.latest()
+	for i := range watcher.statuses {
+		if i >= len(status.Nodes) {
+			break
+		}
+		watcher.statuses[i].mutex.Lock()
+		watcher.statuses[i].status = status.Nodes[i]
+		watcher.statuses[i].mutex.Unlock()
+	}
+}
+
+func (m *daemonMirror) poll(ctx context.Context, watcher *TpuWatcher) {
+	defer close(watcher.updates)
+	eventsSeen := 0
+	logSeq := uint64(0)
+	connected := true
+	for {
+		err := m.refreshStatus()
+		if err == nil {
+			m.copyStatuses(watcher)
+			var events eventsResponse
+			err = m.client.get(fmt.Sprintf("/events?since=%d", eventsSeen), &events)
+			if err == nil {
+				watcher.events.ingest(events.Events)
+				eventsSeen = events.Next
+			}
+		}
+		if err == nil {
+			var logs logsResponse
+			err = m.client.get(fmt.Sprintf("/logs?since=%d", logSeq), &logs)
+			if err == nil {
+				for _, line := range logs.Lines {
+					watcher.logs.ingest(logLine{seq: line.Seq, node: line.Node, text: line.Text})
+				}
+				logSeq = logs.Next
+			}
+		}
+		if err != nil && connected {
+			watcher.events.record(eventError, -1, fmt.Sprintf("lost connection to daemon: %v", err))
+		} else if err == nil && !connected {
+			watcher.events.record(eventState, -1, "reconnected to daemon")
+		}
+		connected = err == nil
+		select {
+		case <-ctx.Done():
+			return
+		case watcher.updates <- TpuStatusUpdate{}:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/spf13/viper"
+)
+
+const discoveryCacheTtl = 24 * time.Hour
+
+// used when gcloud can't tell us, e.g. when offline
+var (
+	fallbackZones           = []string{"us-central2-b", "us-central1-f", "europe-west4-a", "us-east1-d"}
+	fallbackAcceleratorType = []string{"v2-8", "v3-8", "v4-8"}
+)
+
+// trcZones is what the TPU Research Cloud usually grants, by zone and TPU generation.
+// Grants differ between accounts, so this is only a hint.
+var trcZones = map[string][]string{
+	"us-central1-f":  {"v2"},
+	"europe-west4-a": {"v2", "v3", "v6e"},
+	"us-central2-b":  {"v4"},
+	"europe-west4-b": {"v5litepod"},
+	"us-central1-a":  {"v5litepod"},
+	"us-east1-d":     {"v6e"},
+}
+
+func tpuGeneration(acceleratorType string) string {
+	generation, _, _ := strings.Cut(acceleratorType, "-")
+	return generation
+}
+
+func trcCovers(zone, acceleratorType string) bool {
+	for _, generation := range trcZones[zone] {
+		if generation == tpuGeneration(acceleratorType) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedGcloud runs a gcloud listing and keeps its output under ~/.raleigh/cache for a day.
+func cachedGcloud(name string, result any, args ...string) error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("error getting home directory: %w", err)
+	}
+	cacheDir := filepath.Join(homeDir, ".raleigh", "cache")
+	cachePath := filepath.Join(cacheDir, name+".json")
+	stat, err := os.Stat(cachePath)
+	if err == nil && time.Since(stat.ModTime()) < discoveryCacheTtl {
+		output, err := os.ReadFile(cachePath)
+		if err == nil && json.Unmarshal(output, result) == nil {
+			return nil
+		}
+	}
+	ctx, cancel := localTimeout()
+	defer cancel()
+	output, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", append(args, "--format", "json", "--quiet")...))
+	if err != nil {
+		return fmt.Errorf("error running gcloud %s: %w", strings.Join(args[:min(len(args), 4)], " "), err)
+	}
+	err = json.Unmarshal(output, result)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling gcloud output: %w", err)
+	}
+	err = os.MkdirAll(cacheDir, 0755)
+	if err == nil {
+		err = os.WriteFile(cachePath, output, 0644)
+	}
+	if err != nil {
+		logger.Warn("error caching gcloud output", "name", name, "err", err)
+	}
+	return nil
+}
+
+func listTpuZones(project string) ([]string, error) {
+	var locations []struct {
+		LocationId string `json:"locationId"`
+	}
+	err := cachedGcloud("zones-"+project, &locations, "compute", "tpus", "locations", "list", "--project", project)
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]string, len(locations))
+	for i, location := range locations {
+		zones[i] = location.LocationId
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+func listAcceleratorTypes(project, zone string) ([]string, error) {
+	var acceleratorTypes []struct {
+		Type string `json:"type"`
+	}
+	err := cachedGcloud("accelerator-types-"+project+"-"+zone, &acceleratorTypes, "compute", "tpus", "tpu-vm", "accelerator-types", "list", "--zone", zone, "--project", project)
+	if err != nil {
+		return nil, err
+	}
+	types := make([]string, len(acceleratorTypes))
+	for i, acceleratorType := range acceleratorTypes {
+		types[i] = acceleratorType.Type
+	}
+	sort.Slice(types, func(i, j int) bool {
+		// v2-8 before v2-32
+		gi, gj := tpuGeneration(types[i]), tpuGeneration(types[j])
+		if gi != gj {
+			return gi < gj
+		}
+		return acceleratorSize(types[i]) < acceleratorSize(types[j])
+	})
+	return types, nil
+}
+
+func acceleratorSize(acceleratorType string) int {
+	_, size, _ := strings.Cut(acceleratorType, "-")
+	n, _ := strconv.Atoi(size)
+	return n
+}
+
+type tpuQuotaBucket struct {
+	EffectiveLimit string            `json:"effectiveLimit"`
+	Dimensions     map[string]string `json:"dimensions"`
+}
+
+type tpuQuotaMetric struct {
+	Metric              string `json:"metric"`
+	ConsumerQuotaLimits []struct {
+		QuotaBuckets []tpuQuotaBucket `json:"quotaBuckets"`
+	} `json:"consumerQuotaLimits"`
+}
+
+func listTpuQuotas(project string) ([]tpuQuotaMetric, error) {
+	var metrics []tpuQuotaMetric
+	err := cachedGcloud("quotas-"+project, &metrics, "alpha", "services", "quota", "list", "--service", "tpu.googleapis.com", "--consumer", "projects/"+project)
+	return metrics, err
+}
+
+// tpuQuota finds the limit for a TPU generation in a zone. Metric names look like
+// tpu.googleapis.com/v3_cores or .../tpu_v4_preemptible_cores, so this is a best guess.
+func tpuQuota(metrics []tpuQuotaMetric, zone, acceleratorType string, preemptible bool) (int64, bool) {
+	generation := strings.TrimSuffix(tpuGeneration(acceleratorType), "pod")
+	for _, metric := range metrics {
+		name := strings.ToLower(metric.Metric)
+		if !strings.Contains(name, generation+"_") || strings.Contains(name, "preemptible") != preemptible {
+			continue
+		}
+		limit, found := int64(0), false
+		for _, quotaLimit := range metric.ConsumerQuotaLimits {
+			for _, bucket := range quotaLimit.QuotaBuckets {
+				bucketZone, zonal := bucket.Dimensions["zone"]
+				if zonal && bucketZone != zone {
+					continue
+				}
+				// a zone's own bucket wins over the project-wide default
+				if found && !zonal {
+					continue
+				}
+				// zero limits are left out of the response
+				limit, _ = strconv.ParseInt(bucket.EffectiveLimit, 10, 64)
+				found = true
+			}
+		}
+		if found {
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+func selectRegion(m tea.Model) tea.Model {
+	var modelGetter tea.Cmd = func() tea.Msg {
+		title := "Select Region"
+		zones, err := listTpuZones(viper.GetString("project"))
+		if err != nil || len(zones) == 0 {
+			logger.Warn("error listing zones", "err", err)
+			zones = fallbackZones
+			title += " (offline)"
+		}
+		items := make([]simpleListItem, len(zones))
+		for i, zone := range zones {
+			items[i] = simpleListItem{name: zone, id: zone}
+			if generations, ok := trcZones[zone]; ok {
+				items[i].description = "TRC: " + strings.Join(generations, ", ")
+			}
+		}
+		return gotNextModel(createList(setDefault(items, viper.GetString("region")), title, func(id string) tea.Model {
+			viper.Set("region", id)
+			viper.WriteConfig()
+			return m
+		}))
+	}
+	return simpleSpinner(modelGetter, "Loading zones...")
+}
+
+func selectInstanceType(m tea.Model) tea.Model {
+	var modelGetter tea.Cmd = func() tea.Msg {
+		project, zone := viper.GetString("project"), viper.GetString("region")
+		title := "Select Instance Type in " + zone
+		types, err := listAcceleratorTypes(project, zone)
+		if err != nil || len(types) == 0 {
+			logger.Warn("error listing accelerator types", "zone", zone, "err", err)
+			types = fallbackAcceleratorType
+			title += " (offline)"
+		}
+		quotas, err := listTpuQuotas(project)
+		if err != nil {
+			logger.Warn("error listing quotas", "err", err)
+		}
+		preemptible := viper.GetBool("spot") || viper.GetBool("preemptible")
+		items := make([]simpleListItem, len(types))
+		for i, acceleratorType := range types {
+			annotations := []string{}
+			if quota, ok := tpuQuota(quotas, zone, acceleratorType, preemptible); ok {
+				annotations = append(annotations, fmt.Sprintf("quota %d", quota))
+			} else {
+				annotations = append(annotations, "quota unknown")
+			}
+			if trcCovers(zone, acceleratorType) {
+				annotations = append(annotations, "TRC")
+			}
+			items[i] = simpleListItem{name: acceleratorType, id: acceleratorType, description: strings.Join(annotations, " • ")}
+		}
+		return gotNextModel(createList(setDefault(items, viper.GetString("instanceType")), title, func(id string) tea.Model {
+			viper.Set("instanceType", id)
+			viper.WriteConfig()
+			return m
+		}))
+	}
+	return simpleSpinner(modelGetter, "Loading accelerator types...")
+}
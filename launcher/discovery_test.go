@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// quotaListing is shaped like gcloud alpha services quota list output.
+const quotaListing = `[
+  {"metric": "tpu.googleapis.com/v3_cores", "consumerQuotaLimits": [{"quotaBuckets": [
+    {"effectiveLimit": "8"},
+    {"effectiveLimit": "32", "dimensions": {"zone": "europe-west4-a"}}
+  ]}]},
+  {"metric": "tpu.googleapis.com/v3_preemptible_cores", "consumerQuotaLimits": [{"quotaBuckets": [
+    {"effectiveLimit": "64", "dimensions": {"zone": "europe-west4-a"}},
+    {"effectiveLimit": "16"}
+  ]}]},
+  {"metric": "tpu.googleapis.com/tpu_v4_cores", "consumerQuotaLimits": [{"quotaBuckets": [
+    {"dimensions": {"zone": "us-central2-b"}}
+  ]}]},
+  {"metric": "tpu.googleapis.com/v5lite_cores", "consumerQuotaLimits": [{"quotaBuckets": [
+    {"effectiveLimit": "128", "dimensions": {"zone": "us-west4-a"}}
+  ]}]}
+]`
+
+func TestTpuQuota(t *testing.T) {
+	var metrics []tpuQuotaMetric
+	err := json.Unmarshal([]byte(quotaListing), &metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		zone            string
+		acceleratorType string
+		preemptible     bool
+		want            int64
+		wantFound       bool
+	}{
+		{"zone bucket wins", "europe-west4-a", "v3-8", false, 32, true},
+		{"default bucket elsewhere", "us-central1-a", "v3-8", false, 8, true},
+		{"preemptible metric", "europe-west4-a", "v3-32", true, 64, true},
+		{"preemptible zone bucket listed first", "europe-west4-a", "v3-8", true, 64, true},
+		{"preemptible default", "us-central1-a", "v3-8", true, 16, true},
+		{"zero limit is left out", "us-central2-b", "v4-8", false, 0, true},
+		{"pod suffix", "us-west4-a", "v5litepod-16", false, 128, true},
+		{"other zone only", "europe-west4-b", "v5litepod-16", false, 0, false},
+		{"unknown generation", "europe-west4-a", "v6e-8", false, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, found := tpuQuota(metrics, test.zone, test.acceleratorType, test.preemptible)
+			if got != test.want || found != test.wantFound {
+				t.Errorf("tpuQuota(%s, %s, %v) = %d, %v, want %d, %v", test.zone, test.acceleratorType, test.preemptible, got, found, test.want, test.wantFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// The doctor checks what setup needs before anything is created, so a missing key or a closed
+// port shows up with a fix instead of as an rsync error minutes later. Starting runs the same
+// checks as a preflight and only refuses to go on when one of them fails outright, except for
+// the advisory ones, which can be wrong about a project that works.
+
+type checkStatus string
+
+const (
+	checkPass checkStatus = "pass"
+	// something looks off, but the launcher may still work
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+	// an earlier check failed, so this one couldn't run
+	checkSkip checkStatus = "skip"
+)
+
+type checkResult struct {
+	Name   string      `json:"name"`
+	Status checkStatus `json:"status"`
+	Detail string      `json:"detail,omitempty"`
+	Fix    string      `json:"fix,omitempty"`
+	// advisory checks guess from part of the picture, the preflight only warns about them
+	advisory bool
+}
+
+func (r checkResult) String() string {
+	symbol := map[checkStatus]string{checkPass: "✓", checkWarn: "!", checkFail: "✗", checkSkip: "-"}[r.Status]
+	s := symbol + " " + r.Name
+	if r.Detail != "" {
+		s += ": " + r.Detail
+	}
+	if r.Fix != "" {
+		s += "\n    fix: " + r.Fix
+	}
+	return s
+}
+
+type cloudCheck struct {
+	name     string
+	run      func(context.Context, TpuConfig) checkResult
+	advisory bool
+}
+
+var cloudChecks = []cloudCheck{
+	// the listing is cached for a day
+	{"accelerator type", checkAcceleratorType, true},
+	{"quota", checkQuota, false},
+	// only VPC rules on the default network, not firewall policies, source ranges or tags
+	{"firewall", checkFirewall, true},
+	{"sudo", checkOsLoginSudo, false},
+}
+
+// runChecks runs every check, the local ones first. Checks that need the project are skipped
+// when the credentials or the project don't work, they'd only repeat the same error.
+func runChecks(ctx context.Context, cfg TpuConfig) []checkResult {
+	results := []checkResult{
+		checkGcloud(ctx),
+		checkBinary(ctx, "rsync", "--version"),
+		checkBinary(ctx, "ssh", "-V"),
+		checkSshKey(),
+		checkRepo(cfg),
+		checkConfig(),
+	}
+	credentials := checkCloudCredentials(ctx)
+	project := checkResult{Name: "project", Status: checkSkip}
+	if credentials.Status == checkPass {
+		project = checkProject(ctx, cfg)
+	}
+	results = append(results, credentials, project)
+
+	cloudResults := make([]checkResult, len(cloudChecks))
+	var wg sync.WaitGroup
+	for i, check := range cloudChecks {
+		if project.Status != checkPass {
+			cloudResults[i] = checkResult{Name: check.name, Status: checkSkip}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cloudResults[i] = check.run(ctx, cfg)
+			cloudResults[i].Name = check.name
+			cloudResults[i].advisory = check.advisory
+		}()
+	}
+	wg.Wait()
+	return append(results, cloudResults...)
+}
+
+// preflight runs the checks before the watcher starts. Warnings, and failures of advisory
+// checks, are only logged.
+func preflight(ctx context.Context, cfg TpuConfig) error {
+	if replay != nil {
+		// nothing about this machine matters to a replay
+		return nil
+	}
+	failed := []string{}
+	for _, result := range runChecks(ctx, cfg) {
+		switch {
+		case result.Status == checkFail && !result.advisory:
+			failed = append(failed, result.String())
+		case result.Status == checkFail, result.Status == checkWarn:
+			logger.Warn("preflight", "check", result.Name, "detail", result.Detail, "fix", result.Fix)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("preflight failed, run raleigh doctor for the full report\n%s", strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+// startWatcher is NewTpuWatcher behind the preflight.
+func startWatcher(ctx context.Context, cfg TpuConfig) (*TpuWatcher, error) {
+	err := preflight(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewTpuWatcher(ctx, cfg), nil
+}
+
+// localOutput runs a local tool, outside the command budgets and the audit log.
+func localOutput(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := withTimeout(ctx, viper.GetDuration("commandTimeout"))
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%s is not installed or not on PATH", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error running %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func checkGcloud(ctx context.Context) checkResult {
+	result := checkResult{Name: "gcloud"}
+	output, err := localOutput(ctx, "gcloud", "version", "--format", "json")
+	if err != nil {
+		result.Status, result.Detail = checkFail, err.Error()
+		result.Fix = "install the Google Cloud SDK: https://cloud.google.com/sdk/docs/install"
+		return result
+	}
+	var components map[string]string
+	err = json.Unmarshal([]byte(output), &components)
+	if err != nil {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("error reading gcloud version: %v", err)
+		return result
+	}
+	result.Status, result.Detail = checkPass, "Google Cloud SDK "+components["Google Cloud SDK"]
+	if _, ok := components["alpha"]; !ok {
+		// the instance type picker reads quotas with gcloud alpha
+		result.Status = checkWarn
+		result.Detail += ", without the alpha component, so quotas are unknown"
+		result.Fix = "gcloud components install alpha"
+	}
+	return result
+}
+
+// checkBinary makes sure a tool is there and shows the first line of its version.
+func checkBinary(ctx context.Context, name string, versionFlag string) checkResult {
+	result := checkResult{Name: name}
+	output, err := localOutput(ctx, name, versionFlag)
+	if err != nil {
+		result.Status, result.Detail = checkFail, err.Error()
+		result.Fix = "install " + name + " with your package manager"
+		return result
+	}
+	version, _, _ := strings.Cut(output, "\n")
+	result.Status, result.Detail = checkPass, version
+	return result
+}
+
+// checkSshKey looks at the launcher's own key, which the first start generates and registers.
+func checkSshKey() checkResult {
+	result := checkResult{Name: "ssh key"}
+	access, err := newSshAccess()
+	if err != nil {
+		result.Status, result.Detail = checkFail, err.Error()
+		return result
+	}
+	stat, err := os.Stat(access.keyPath)
+	if err != nil {
+		if _, err := exec.LookPath("ssh-keygen"); err != nil {
+			result.Status, result.Detail = checkFail, "ssh-keygen is not installed or not on PATH, so no key can be generated"
+			result.Fix = "install OpenSSH with your package manager"
+			return result
+		}
+		result.Status, result.Detail = checkPass, access.keyPath+" is generated on the next start"
+		return result
+	}
+	if stat.Mode().Perm()&0077 != 0 {
+		// ssh refuses keys others can read
+		result.Status, result.Detail = checkFail, fmt.Sprintf("%s is readable by others (%o)", access.keyPath, stat.Mode().Perm())
+		result.Fix = "chmod 600 " + access.keyPath
+		return result
+	}
+	result.Status, result.Detail = checkPass, fmt.Sprintf("%s (sshKeys %s)", access.keyPath, viper.GetString("sshKeys"))
+	return result
+}
+
+// checkRepo makes sure there is something to sync, an uninitialized submodule is an empty directory.
+func checkRepo(cfg TpuConfig) checkResult {
+	result := checkResult{Name: "repo"}
+	submodule := "git submodule update --init --recursive"
+	entries, err := os.ReadDir(cfg.repoPath)
+	if err != nil {
+		result.Status, result.Detail = checkFail, fmt.Sprintf("error reading repoPath %s: %v", cfg.repoPath, err)
+		result.Fix = submodule + ", or set repoPath"
+		return result
+	}
+	if len(entries) == 0 {
+		result.Status, result.Detail, result.Fix = checkFail, cfg.repoPath+" is empty", submodule
+		return result
+	}
+	result.Status, result.Detail = checkPass, cfg.repoPath
+	usesUv := strings.Contains(cfg.installCommand, "uv ") || strings.Contains(cfg.runCommand, "uv run")
+	if _, err := os.Stat(filepath.Join(cfg.repoPath, "pyproject.toml")); err != nil && usesUv {
+		result.Status = checkWarn
+		result.Detail = fmt.Sprintf("%s has no pyproject.toml, but the install or run command uses uv", cfg.repoPath)
+		result.Fix = "point repoPath at the project, or change installCommand and runCommand"
+	}
+	return result
+}
+
+// checkConfig runs every setting's check against the saved config, like the settings form does.
+func checkConfig() checkResult {
+	result := checkResult{Name: "config"}
+	values := map[string]string{}
+	for _, field := range settingFields {
+		values[field.key] = viper.GetString(field.key)
+	}
+	problems := []string{}
+	for _, field := range settingFields {
+		err := field.check(values[field.key], values)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field.key, err))
+		}
+	}
+	_, err := GetRunConfig()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, key := range []string{"project", "region", "instanceType"} {
+		if viper.GetString(key) == "" {
+			problems = append(problems, key+" is not set")
+		}
+	}
+	if len(problems) > 0 {
+		result.Status, result.Detail = checkFail, strings.Join(problems, "; ")
+		result.Fix = "raleigh config set <key> <value>, or the settings in the UI"
+		return result
+	}
+	result.Status, result.Detail = checkPass, viper.ConfigFileUsed()
+	return result
+}
+
+func checkCloudCredentials(ctx context.Context) checkResult {
+	result := checkResult{Name: "credentials"}
+	err := setupAuth()
+	if err == nil {
+		err = checkCredentials(ctx)
+	}
+	if err != nil {
+		// the errors already say what to run
+		result.Status, result.Detail = checkFail, err.Error()
+		return result
+	}
+	result.Status, result.Detail = checkPass, "authMode "+viper.GetString("authMode")
+	return result
+}
+
+func checkProject(ctx context.Context, cfg TpuConfig) checkResult {
+	result := checkResult{Name: "project"}
+	err := checkProjectAccess(ctx, cfg)
+	if err != nil {
+		result.Status, result.Detail = checkFail, err.Error()
+		if kind := failureOf(err); kind != failureUnknown {
+			result.Fix = kind.Hint()
+		}
+		return result
+	}
+	result.Status, result.Detail = checkPass, fmt.Sprintf("TPU API enabled in %s", cfg.project)
+	return result
+}
+
+func checkAcceleratorType(_ context.Context, cfg TpuConfig) checkResult {
+	result := checkResult{}
+	types, err := listAcceleratorTypes(cfg.project, cfg.zone)
+	if err != nil {
+		result.Status, result.Detail = checkWarn, err.Error()
+		return result
+	}
+	for _, acceleratorType := range types {
+		if acceleratorType == cfg.instanceType {
+			result.Status, result.Detail = checkPass, fmt.Sprintf("%s is offered in %s", cfg.instanceType, cfg.zone)
+			return result
+		}
+	}
+	result.Status, result.Detail = checkFail, fmt.Sprintf("%s is not offered in %s", cfg.instanceType, cfg.zone)
+	result.Fix = fmt.Sprintf("pick another instance type or zone, gcloud compute tpus tpu-vm accelerator-types list --zone %s --project %s shows what there is", cfg.zone, cfg.project)
+	return result
+}
+
+// checkQuota compares the zone's quota with the cores all TPUs need. Quota metrics are matched by
+// name and counted in chips for some generations, so this only ever warns.
+func checkQuota(_ context.Context, cfg TpuConfig) checkResult {
+	result := checkResult{}
+	metrics, err := listTpuQuotas(cfg.project)
+	if err != nil {
+		result.Status, result.Detail = checkWarn, err.Error()
+		return result
+	}
+	preemptible := cfg.spot || cfg.preemptible
+	quota, ok := tpuQuota(metrics, cfg.zone, cfg.instanceType, preemptible)
+	if !ok {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("no quota found for %s in %s", tpuGeneration(cfg.instanceType), cfg.zone)
+		return result
+	}
+	needed := int64(cfg.numTpus * acceleratorSize(cfg.instanceType))
+	result.Status, result.Detail = checkPass, fmt.Sprintf("quota %d in %s, %d TPUs of %s need %d", quota, cfg.zone, cfg.numTpus, cfg.instanceType, needed)
+	if quota < needed {
+		result.Status = checkWarn
+		result.Fix = fmt.Sprintf("request more quota: https://console.cloud.google.com/iam-admin/quotas?project=%s (listings are cached for a day in ~/.raleigh/cache)", cfg.project)
+	}
+	return result
+}
+
+type firewallRule struct {
+	Name      string `json:"name"`
+	Network   string `json:"network"`
+	Direction string `json:"direction"`
+	Disabled  bool   `json:"disabled"`
+	Allowed   []struct {
+		IPProtocol string   `json:"IPProtocol"`
+		Ports      []string `json:"ports"`
+	} `json:"allowed"`
+}
+
+// allows reports whether the rule lets tcp traffic through to every port from low to high.
+func (r firewallRule) allows(low, high int) bool {
+	if r.Disabled || r.Direction != "INGRESS" {
+		return false
+	}
+	for _, allowed := range r.Allowed {
+		if allowed.IPProtocol != "tcp" && allowed.IPProtocol != "all" {
+			continue
+		}
+		if len(allowed.Ports) == 0 {
+			return true
+		}
+		for _, ports := range allowed.Ports {
+			first, last, isRange := strings.Cut(ports, "-")
+			if !isRange {
+				last = first
+			}
+			from, errFrom := strconv.Atoi(first)
+			to, errTo := strconv.Atoi(last)
+			if errFrom == nil && errTo == nil && from <= low && high <= to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkFirewall looks for rules on the default network, which the TPUs are created in, that let
+// ssh in and let the TPUs reach each other on the ports the training processes get.
+func checkFirewall(ctx context.Context, cfg TpuConfig) checkResult {
+	result := checkResult{}
+	ctx, cancel := withTimeout(ctx, cfg.commandTimeout)
+	defer cancel()
+	output, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", "compute", "firewall-rules", "list", "--project", cfg.project, "--format", "json", "--quiet"))
+	if err != nil {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("error listing firewall rules: %v", err)
+		result.Fix = fmt.Sprintf("the Compute Engine API may be disabled, gcloud services enable compute.googleapis.com --project %s", cfg.project)
+		return result
+	}
+	var rules []firewallRule
+	err = json.Unmarshal(output, &rules)
+	if err != nil {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("error unmarshalling firewall rules: %v", err)
+		return result
+	}
+	allows := func(low, high int) string {
+		for _, rule := range rules {
+			if strings.HasSuffix(rule.Network, "/default") && rule.allows(low, high) {
+				return rule.Name
+			}
+		}
+		return ""
+	}
+	sshRule, internalRule := allows(22, 22), allows(processPortLow, processPortHigh)
+	if sshRule == "" {
+		result.Status, result.Detail = checkFail, "no rule on the default network lets ssh (tcp:22) in"
+		result.Fix = fmt.Sprintf("gcloud compute firewall-rules create raleigh-allow-ssh --project %s --network default --allow tcp:22", cfg.project)
+		return result
+	}
+	if internalRule == "" {
+		result.Status = checkWarn
+		result.Detail = fmt.Sprintf("ssh is allowed by %s, but no rule lets the TPUs reach each other on tcp:%d-%d", sshRule, processPortLow, processPortHigh)
+		result.Fix = fmt.Sprintf("gcloud compute firewall-rules create raleigh-allow-internal --project %s --network default --allow tcp:1024-65535 --source-ranges 10.128.0.0/9", cfg.project)
+		return result
+	}
+	result.Status, result.Detail = checkPass, fmt.Sprintf("ssh allowed by %s, tcp:%d-%d by %s", sshRule, processPortLow, processPortHigh, internalRule)
+	return result
+}
+
+// osAdminRoles give an OS Login user passwordless sudo, which root commands need.
+var osAdminRoles = []string{"roles/compute.osAdminLogin", "roles/owner"}
+
+// checkOsLoginSudo looks for the account in the project's bindings of osAdminRoles. Roles that come
+// from a group or the organization don't show up there, so not finding it is only a warning.
+func checkOsLoginSudo(ctx context.Context, cfg TpuConfig) checkResult {
+	result := checkResult{}
+	if sshKeyMode(viper.GetString("sshKeys")) != sshKeysOsLogin {
+		result.Status, result.Detail = checkPass, "not needed, ssh logs in as root with metadata keys"
+		return result
+	}
+	ctx, cancel := withTimeout(ctx, cfg.commandTimeout)
+	defer cancel()
+	account := viper.GetString("impersonateServiceAccount")
+	if authMode(viper.GetString("authMode")) != authImpersonate {
+		output, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", "config", "get-value", "account", "--quiet"))
+		if err != nil {
+			result.Status, result.Detail = checkWarn, fmt.Sprintf("error getting the active account: %v", err)
+			return result
+		}
+		account = strings.TrimSpace(string(output))
+	}
+	output, err := outputCmd(ctx, "gcloud", "", exec.CommandContext(ctx, "gcloud", "projects", "get-iam-policy", cfg.project, "--format", "json", "--quiet"))
+	if err != nil {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("error reading the IAM policy: %v", err)
+		return result
+	}
+	var policy struct {
+		Bindings []struct {
+			Role    string   `json:"role"`
+			Members []string `json:"members"`
+		} `json:"bindings"`
+	}
+	err = json.Unmarshal(output, &policy)
+	if err != nil {
+		result.Status, result.Detail = checkWarn, fmt.Sprintf("error unmarshalling the IAM policy: %v", err)
+		return result
+	}
+	for _, binding := range policy.Bindings {
+		if !slices.Contains(osAdminRoles, binding.Role) {
+			continue
+		}
+		for _, member := range binding.Members {
+			if member == "user:"+account || member == "serviceAccount:"+account {
+				result.Status, result.Detail = checkPass, fmt.Sprintf("%s has %s", account, binding.Role)
+				return result
+			}
+		}
+	}
+	result.Status = checkWarn
+	result.Detail = fmt.Sprintf("%s has no %s in %s, without passwordless sudo the launcher can't manage the training process", account, strings.Join(osAdminRoles, " or "), cfg.project)
+	result.Fix = fmt.Sprintf("gcloud projects add-iam-policy-binding %s --member user:%s --role roles/compute.osAdminLogin", cfg.project, account)
+	return result
+}
+
+// the range GetUnusedPorts picks from on the TPUs, Linux's ephemeral ports
+const (
+	processPortLow  = 32768
+	processPortHigh = 60999
+)
+
+func cliDoctor(ctx context.Context, cfg TpuConfig, args []string) int {
+	flags, asJson := newFlagSet("doctor")
+	if flags.Parse(args) != nil {
+		return exitUsage
+	}
+	out := &cliOutput{json: *asJson}
+	counts := map[checkStatus]int{}
+	for _, result := range runChecks(ctx, cfg) {
+		counts[result.Status]++
+		out.print(result, "%s", result)
+	}
+	if !out.json {
+		fmt.Printf("\n%d passed, %d warnings, %d failed, %d skipped\n", counts[checkPass], counts[checkWarn], counts[checkFail], counts[checkSkip])
+	}
+	if counts[checkFail] > 0 {
+		return exitError
+	}
+	return exitOk
+}
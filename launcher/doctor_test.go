@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFirewallRuleAllows(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      string
+		low, high int
+		want      bool
+	}{
+		{"single port", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["22"]}]}`, 22, 22, true},
+		{"other port", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["22"]}]}`, 8470, 8470, false},
+		{"range covers", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["8000-9000"]}]}`, 8470, 8479, true},
+		{"range starts too late", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["8475-9000"]}]}`, 8470, 8479, false},
+		{"range ends too early", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["8000-8472"]}]}`, 8470, 8479, false},
+		{"split ranges don't add up", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["8470-8474", "8475-8479"]}]}`, 8470, 8479, false},
+		{"second entry covers", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["22", "1-65535"]}]}`, 8470, 8479, true},
+		{"every port", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp"}]}`, 8470, 8479, true},
+		{"every protocol", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "all"}]}`, 22, 22, true},
+		{"udp only", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "udp", "ports": ["1-65535"]}]}`, 22, 22, false},
+		{"egress", `{"direction": "EGRESS", "allowed": [{"IPProtocol": "tcp"}]}`, 22, 22, false},
+		{"disabled", `{"direction": "INGRESS", "disabled": true, "allowed": [{"IPProtocol": "tcp"}]}`, 22, 22, false},
+		{"garbage ports", `{"direction": "INGRESS", "allowed": [{"IPProtocol": "tcp", "ports": ["ssh"]}]}`, 22, 22, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := firewallRule{}
+			err := json.Unmarshal([]byte(test.rule), &rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.allows(test.low, test.high); got != test.want {
+				t.Errorf("allows(%d, %d) = %v, want %v", test.low, test.high, got, test.want)
+			}
+		})
+	}
+}
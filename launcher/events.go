@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxEvents = 2000
+
+type eventKind string
+
+const (
+	eventState          eventKind = "state"
+	eventInstall        eventKind = "install"
+	eventClone          eventKind = "clone"
+	eventGroupFormed    eventKind = "group-formed"
+	eventGroupDissolved eventKind = "group-dissolved"
+	eventProcessStarted eventKind = "process-started"
+	eventProcessExited  eventKind = "process-exited"
+	eventStop           eventKind = "stop"
+	eventAction         eventKind = "action"
+	eventError          eventKind = "error"
+)
+
+var eventKinds = []eventKind{
+	eventState, eventInstall, eventClone, eventGroupFormed, eventGroupDissolved,
+	eventProcessStarted, eventProcessExited, eventStop, eventAction, eventError,
+}
+
+// event is one entry of the timeline. Node is -1 for events about the whole group.
+type event struct {
+	At      time.Time `json:"at"`
+	Kind    eventKind `json:"kind"`
+	Node    int       `json:"node"`
+	GroupId int       `json:"group_id"`
+	Message string    `json:"message"`
+	// Hint says what to do about an error event
+	Hint string `json:"hint,omitempty"`
+}
+
+// eventLog is a ring buffer of everything that happened to the fleet. Each event is also
+// appended to ~/.raleigh/runs/<group id>/events.jsonl for post-mortems, or, outside of any
+// group, to ~/.raleigh/events/<launcher start>.jsonl.
+type eventLog struct {
+	mutex      sync.Mutex
+	events     []event
+	total      int
+	groupId    int
+	lastByNode map[int]string
+	formed     map[int]bool
+	dissolved  map[int]bool
+	started    time.Time
+	// the file of the group being written to, and the one for events outside of any group
+	groupFile   *os.File
+	fileGroupId int
+	launchFile  *os.File
+	counts      map[eventKind]int
+	preempted   int
+	// a mirror of a daemon's log doesn't write events.jsonl, the daemon already does
+	mirror bool
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{
+		lastByNode: map[int]string{},
+		formed:     map[int]bool{},
+		dissolved:  map[int]bool{},
+		started:    time.Now(),
+		counts:     map[eventKind]int{},
+	}
+}
+
+func (l *eventLog) record(kind eventKind, node int, message string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.recordLocked(event{At: time.Now(), Kind: kind, Node: node, GroupId: l.groupId, Message: message})
+}
+
+func (l *eventLog) recordLocked(e event) {
+	if e.Node >= 0 {
+		key := string(e.Kind) + e.Message
+		if l.lastByNode[e.Node] == key {
+			// the same error every five seconds is one event
+			return
+		}
+		l.lastByNode[e.Node] = key
+	}
+	l.events = append(l.events, e)
+	l.total++
+	l.counts[e.Kind]++
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+	l.persist(e)
+}
+
+func (l *eventLog) persist(e event) {
+	if l.mirror {
+		return
+	}
+	file := l.launchFile
+	if e.GroupId == 0 && file == nil {
+		file = l.openLaunchFile()
+		l.launchFile = file
+	}
+	if e.GroupId != 0 {
+		if e.GroupId != l.fileGroupId {
+			l.closeGroupFile()
+			l.groupFile = openGroupEventFile(e.GroupId)
+			l.fileGroupId = e.GroupId
+		}
+		file = l.groupFile
+	}
+	if file == nil {
+		return
+	}
+	eventJson, err := json.Marshal(e)
+	if err != nil {
+		logger.Warn("error marshalling event", "err", err)
+		return
+	}
+	file.Write(append(eventJson, '\n'))
+}
+
+func (l *eventLog) openLaunchFile() *os.File {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		logger.Warn("error opening event log", "err", err)
+		return nil
+	}
+	dir := filepath.Join(homeDir, ".raleigh", "events")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		logger.Warn("error opening event log", "err", err)
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(dir, l.started.Format("20060102-150405")+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Warn("error opening event log", "err", err)
+		return nil
+	}
+	return file
+}
+
+func openGroupEventFile(groupId int) *os.File {
+	runDir, err := localRunDir(groupId)
+	if err != nil {
+		logger.Warn("error opening event log", "group", groupId, "err", err)
+		return nil
+	}
+	file, err := os.OpenFile(filepath.Join(runDir, "events.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Warn("error opening event log", "group", groupId, "err", err)
+		return nil
+	}
+	return file
+}
+
+func (l *eventLog) closeGroupFile() {
+	if l.groupFile != nil {
+		l.groupFile.Close()
+	}
+	l.groupFile = nil
+	l.fileGroupId = 0
+}
+
+func (l *eventLog) Error(node int, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.recordLocked(event{At: time.Now(), Kind: eventError, Node: node, GroupId: l.groupId, Message: err.Error(), Hint: failureOf(err).Hint()})
+}
+
+// GroupFormed may be called by every rank of the group; only the first call is recorded.
+func (l *eventLog) GroupFormed(groupId int, size int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.formed[groupId] {
+		return
+	}
+	// every rank passed a barrier before this group formed, so none still reports older ones
+	clear(l.formed)
+	clear(l.dissolved)
+	l.formed[groupId] = true
+	l.groupId = groupId
+	l.recordLocked(event{At: time.Now(), Kind: eventGroupFormed, Node: -1, GroupId: groupId, Message: fmt.Sprintf("group %d formed with %d ranks", groupId, size)})
+}
+
+// GroupDissolved may be called by every rank of the group; only the first call is recorded.
+func (l *eventLog) GroupDissolved(groupId int, reason string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.dissolved[groupId] {
+		return
+	}
+	l.dissolved[groupId] = true
+	l.recordLocked(event{At: time.Now(), Kind: eventGroupDissolved, Node: -1, GroupId: groupId, Message: fmt.Sprintf("group %d dissolved: %s", groupId, reason)})
+	if l.groupId == groupId {
+		l.groupId = 0
+	}
+	if l.fileGroupId == groupId {
+		// nothing else is written for a dissolved group
+		l.closeGroupFile()
+	}
+}
+
+func (l *eventLog) recordTransitions(id int, previous, current TpuStatusUpdate, stopSignal string) {
+	if previous.status != current.status {
+		l.record(eventState, id, fmt.Sprintf("state %s -> %s", previous.status, current.status))
+		if current.status == tpuStatusPreempted {
+			l.mutex.Lock()
+			l.preempted++
+			l.mutex.Unlock()
+		}
+	}
+	if previous.installed != current.installed {
+		l.record(eventInstall, id, fmt.Sprintf("installed: %v", current.installed))
+	}
+	if previous.cloned != current.cloned {
+		l.record(eventClone, id, fmt.Sprintf("cloned: %v", current.cloned))
+	}
+	if previous.running != current.running {
+		if current.running {
+			l.record(eventProcessStarted, id, fmt.Sprintf("process %d running", current.pid))
+		} else {
+			l.record(eventProcessExited, id, "process not running")
+		}
+	}
+	if previous.stopStage != current.stopStage && current.stopStage != stopStageNone {
+		l.record(eventStop, id, "stop: "+current.stopStage.describe(stopSignal))
+	}
+}
+
+// Events returns the buffered events, optionally only those of one node (group events included).
+func (l *eventLog) Events(node int) []event {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if node < 0 {
+		return append([]event{}, l.events...)
+	}
+	events := []event{}
+	for _, e := range l.events {
+		if e.Node == node || e.Node == -1 {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Since returns the events recorded after the first n, and the number recorded so far.
+// Events that already fell out of the buffer are skipped.
+func (l *eventLog) Since(n int) ([]event, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	first := l.total - len(l.events)
+	return append([]event{}, l.events[min(max(n-first, 0), len(l.events)):]...), l.total
+}
+
+// ingest adds events that were recorded elsewhere, as they are.
+func (l *eventLog) ingest(events []event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, events...)
+	l.total += len(events)
+	for _, e := range events {
+		l.counts[e.Kind]++
+	}
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+}
+
+// Counts is how many events of each kind were recorded, and how many preemptions were seen.
+func (l *eventLog) Counts() (map[eventKind]int, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	counts := map[eventKind]int{}
+	for kind, n := range l.counts {
+		counts[kind] = n
+	}
+	return counts, l.preempted
+}
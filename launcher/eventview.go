@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var eventKindStyles = map[eventKind]lipgloss.Style{
+	eventError:          execFailStyle,
+	eventProcessExited:  skewWarnStyle,
+	eventGroupDissolved: skewWarnStyle,
+	eventGroupFormed:    execOkStyle,
+	eventProcessStarted: execOkStyle,
+}
+
+func eventNode(e event, cfg TpuConfig) string {
+	if e.Node < 0 {
+		return "group"
+	}
+	return tpuName(cfg, e.Node)
+}
+
+// matchesEvent checks the query against the fields as shown, without the styling.
+func matchesEvent(e event, cfg TpuConfig, query string) bool {
+	for _, field := range []string{e.At.Format("15:04:05"), string(e.Kind), eventNode(e, cfg), e.Message, e.Hint} {
+		if strings.Contains(field, query) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEvent(e event, cfg TpuConfig) string {
+	node := eventNode(e, cfg)
+	kind := fmt.Sprintf("[%s]", e.Kind)
+	if style, ok := eventKindStyles[e.Kind]; ok {
+		kind = style.Render(kind)
+	}
+	line := fmt.Sprintf("%s %s %s: %s", e.At.Format("15:04:05"), kind, logPrefixStyle.Render(node), strings.ReplaceAll(e.Message, "\n", "\\n"))
+	if e.Hint != "" {
+		line += logHelpStyle.Render(" → " + e.Hint)
+	}
+	return line
+}
+
+// eventViewer is the timeline of everything the watcher saw, filterable by kind and text.
+type eventViewer struct {
+	events    *eventLog
+	cfg       TpuConfig
+	kind      int // index into eventKinds, -1 for all
+	follow    bool
+	searching bool
+	search    textinput.Model
+	query     string
+	viewport  viewport.Model
+}
+
+func newEventViewer(events *eventLog, cfg TpuConfig) eventViewer {
+	search := textinput.New()
+	search.Prompt = "/"
+	return eventViewer{
+		events:   events,
+		cfg:      cfg,
+		kind:     -1,
+		follow:   true,
+		search:   search,
+		viewport: viewport.New(0, 0),
+	}
+}
+
+func (v *eventViewer) SetSize(width, height int) {
+	v.viewport.Width = width
+	v.viewport.Height = max(height-2, 0)
+	v.refresh()
+}
+
+func (v *eventViewer) refresh() {
+	lines := []string{}
+	for _, e := range v.events.Events(-1) {
+		if v.kind >= 0 && e.Kind != eventKinds[v.kind] {
+			continue
+		}
+		if v.query != "" && !matchesEvent(e, v.cfg, v.query) {
+			continue
+		}
+		lines = append(lines, formatEvent(e, v.cfg))
+	}
+	v.viewport.SetContent(strings.Join(lines, "\n"))
+	if v.follow {
+		v.viewport.GotoBottom()
+	}
+}
+
+func (v *eventViewer) Update(msg tea.Msg) tea.Cmd {
+	switch msg := msg.(type) {
+	case monitorTick:
+		v.refresh()
+		return nil
+	case tea.KeyMsg:
+		if v.searching {
+			switch msg.String() {
+			case "enter":
+				v.searching = false
+				v.query = v.search.Value()
+				v.search.Blur()
+				v.refresh()
+				return nil
+			case "esc":
+				v.searching = false
+				v.search.Blur()
+				return nil
+			}
+			var cmd tea.Cmd
+			v.search, cmd = v.search.Update(msg)
+			return cmd
+		}
+		switch msg.String() {
+		case "tab":
+			v.kind++
+			if v.kind >= len(eventKinds) {
+				v.kind = -1
+			}
+			v.refresh()
+			return nil
+		case "shift+tab":
+			v.kind--
+			if v.kind < -1 {
+				v.kind = len(eventKinds) - 1
+			}
+			v.refresh()
+			return nil
+		case "f":
+			v.follow = !v.follow
+			v.refresh()
+			return nil
+		case "/":
+			v.searching = true
+			v.search.SetValue(v.query)
+			return v.search.Focus()
+		case "up", "k", "pgup":
+			v.follow = false
+		}
+	}
+	var cmd tea.Cmd
+	v.viewport, cmd = v.viewport.Update(msg)
+	return cmd
+}
+
+func (v *eventViewer) View() string {
+	builder := strings.Builder{}
+	title := "Events"
+	if v.kind >= 0 {
+		title += fmt.Sprintf(": %s", eventKinds[v.kind])
+	}
+	if v.follow {
+		title += " (following)"
+	}
+	if v.query != "" {
+		title += fmt.Sprintf(" [/%s]", v.query)
+	}
+	builder.WriteString(titleStyle.Render(title))
+	builder.WriteString("\n")
+	builder.WriteString(v.viewport.View())
+	builder.WriteString("\n")
+	if v.searching {
+		builder.WriteString(v.search.View())
+	} else {
+		builder.WriteString(logHelpStyle.Render("tab kind • f follow • / filter • esc back"))
+	}
+	return builder.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const exitStatusPath = "~/.raleigh/exit-status.json"
+
+// stopKilledPath is touched before the stop path escalates to SIGKILL.
+const stopKilledPath = "~/.raleigh/stop-killed"
+
+// runWrapper starts the run command in its own session, forwards stop signals to the whole
+// session and records how it ended in ~/.raleigh/exit-status.json.
+const runWrapper = `#!/bin/bash
+rm -f ~/.raleigh/exit-status.json ~/.raleigh/stop-killed
+start=$(date +%%s)
+cd %s
+setsid bash -c %s &
+child=$!
+for sig in HUP INT TERM USR1 USR2; do
+  trap "kill -s $sig -- -$child 2>/dev/null" $sig
+done
+while true; do
+  wait $child
+  code=$?
+  kill -0 $child 2>/dev/null || break
+done
+# a trap that fired as the child exited cut the last wait short, waiting again gets its own status
+wait $child 2>/dev/null
+last=$?
+[ $last -ne 127 ] && code=$last
+end=$(date +%%s)
+python3 - "$code" "$start" "$end" %d <<'EOF'
+import json, os, signal, subprocess, sys
+code, start, end, group_id = map(int, sys.argv[1:])
+sig = signal.Signals(code - 128).name if 128 < code < 128 + signal.NSIG else ""
+log = os.path.expanduser("~/.raleigh/nohup.log")
+tail = subprocess.run(["tail", "-n", "%d", log], capture_output=True, text=True).stdout
+status = {"exit_code": code, "signal": sig, "start_time": start, "end_time": end, "group_id": group_id, "log_tail": tail,
+          "killed_by_launcher": os.path.exists(os.path.expanduser("~/.raleigh/stop-killed"))}
+with open(os.path.expanduser("~/.raleigh/exit-status.json"), "w") as f:
+    json.dump(status, f)
+EOF
+exit $code
+`
+
+const exitLogTailLines = 50
+
+type exitStatus struct {
+	ExitCode  int    `json:"exit_code"`
+	Signal    string `json:"signal"`
+	StartTime int64  `json:"start_time"`
+	EndTime   int64  `json:"end_time"`
+	GroupId   int    `json:"group_id"`
+	LogTail   string `json:"log_tail"`
+	// KilledByLauncher is set when the stop path sent the SIGKILL.
+	KilledByLauncher bool `json:"killed_by_launcher"`
+}
+
+func (e exitStatus) Failed() bool {
+	return e.ExitCode != 0
+}
+
+func (e exitStatus) Describe() string {
+	desc := fmt.Sprintf("exited %d", e.ExitCode)
+	switch e.Signal {
+	case "":
+	case "SIGKILL":
+		if e.KilledByLauncher {
+			desc += " (SIGKILL, stop escalated)"
+		} else {
+			desc += " (OOM-killed?)"
+		}
+	default:
+		desc += " (" + e.Signal + ")"
+	}
+	return desc
+}
+
+func (t *TpuInstaller) ReadExitStatus(ctx context.Context) (*exitStatus, error) {
+	text, catErr := t.tpuController.ReadFile(ctx, t.cfg.username, exitStatusPath)
+	if catErr != nil {
+		if catErr.IsNoFile() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading exit status: %w", catErr)
+	}
+	status := exitStatus{}
+	err := json.Unmarshal([]byte(text), &status)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling exit status: %w", err)
+	}
+	return &status, nil
+}
+
+// ArchiveExitStatus keeps a local copy of the exit status under ~/.raleigh/runs/<group id>,
+// since the next launch on the node overwrites the remote one.
+func (t *TpuInstaller) ArchiveExitStatus(status exitStatus) error {
+	runDir, err := localRunDir(status.GroupId)
+	if err != nil {
+		return err
+	}
+	statusJson, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling exit status: %w", err)
+	}
+	name := fmt.Sprintf("%s-exit-%s.json", t.tpuController.id, time.Unix(status.EndTime, 0).Format("20060102-150405"))
+	err = os.WriteFile(filepath.Join(runDir, name), statusJson, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing exit status: %w", err)
+	}
+	return nil
+}
+
+// localRunDir is where everything we keep about a group's run lives: ~/.raleigh/runs/<group id>.
+func localRunDir(groupId int) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	runDir := filepath.Join(homeDir, ".raleigh", "runs", fmt.Sprint(groupId))
+	err = os.MkdirAll(runDir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("error creating run directory: %w", err)
+	}
+	return runDir, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// failureKind sorts gcloud, ssh and rsync failures by what the launcher should do about them.
+type failureKind int
+
+const (
+	failureUnknown failureKind = iota
+	failureNotFound
+	failureQuotaExceeded
+	failureCapacityExhausted
+	failurePermissionDenied
+	failurePreempted
+	failureSshUnreachable
+	failureTransient
+	failureRemoteCommand
+	failureRateLimited
+	failureHostKey
+)
+
+func (k failureKind) String() string {
+	switch k {
+	case failureNotFound:
+		return "not found"
+	case failureQuotaExceeded:
+		return "quota exceeded"
+	case failureCapacityExhausted:
+		return "capacity exhausted"
+	case failurePermissionDenied:
+		return "permission denied"
+	case failurePreempted:
+		return "preempted"
+	case failureSshUnreachable:
+		return "ssh unreachable"
+	case failureTransient:
+		return "transient"
+	case failureRemoteCommand:
+		return "remote command failed"
+	case failureRateLimited:
+		return "rate limited"
+	case failureHostKey:
+		return "host key"
+	}
+	return "unknown"
+}
+
+func (k failureKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *failureKind) UnmarshalText(text []byte) error {
+	for kind := failureUnknown; kind <= failureHostKey; kind++ {
+		if kind.String() == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	*k = failureUnknown
+	return nil
+}
+
+// Hint is what the user can do about it, empty when there's nothing to suggest.
+func (k failureKind) Hint() string {
+	switch k {
+	case failureQuotaExceeded:
+		return "request more TPU quota for this zone, lower numTpus, or pick another zone or instanceType"
+	case failureCapacityExhausted:
+		return "the zone is out of TPUs; creation is retried with backoff, or pick another zone"
+	case failurePermissionDenied:
+		return "check gcloud auth list, that the project is right, and that the account can manage TPUs; with sshKeys oslogin, root commands need roles/compute.osAdminLogin"
+	case failurePreempted:
+		return "the TPU was reclaimed; it is deleted and recreated automatically"
+	case failureSshUnreachable:
+		return "the VM may still be booting; if this persists, check firewall rules and ssh keys"
+	case failureTransient:
+		return "a temporary cloud error; it is retried"
+	case failureRemoteCommand:
+		return "see the command output, raleigh ssh <node> to investigate"
+	case failureRateLimited:
+		return "gcloud calls are slowed down automatically; lower apiRate to stay under the API quota"
+	case failureHostKey:
+		return "the TPU publishes no host keys or isn't the one in ~/.raleigh/ssh/known_hosts; delete it (raleigh down --delete) so it is recreated with enable-guest-attributes"
+	}
+	return ""
+}
+
+// retryable failures go away by themselves, the rest need waiting or the user
+func (k failureKind) retryable() bool {
+	return k == failureTransient || k == failureSshUnreachable || k == failureRateLimited
+}
+
+type cloudError struct {
+	kind     failureKind
+	message  string
+	exitCode int
+	err      error
+}
+
+func (e *cloudError) Error() string { return e.message }
+
+func (e *cloudError) Unwrap() error { return e.err }
+
+// cloudPatterns are what gcloud and the TPU API say. ssh, scp and rsync pass on whatever the
+// remote program printed, so only sshPatterns, which the ssh client prints itself, apply to them.
+var cloudPatterns = []failurePattern{
+	// order matters: rate limits mention quota too, and quota errors also say RESOURCE_EXHAUSTED
+	{failureRateLimited, []string{"Quota exceeded for quota metric", "RATE_LIMIT_EXCEEDED", "Rate Limit Exceeded", "rateLimitExceeded", "Too Many Requests", "HTTPError 429"}},
+	{failureQuotaExceeded, []string{"quota", "QUOTA_EXCEEDED"}},
+	{failureCapacityExhausted, []string{"no more capacity", "ZONE_RESOURCE_POOL_EXHAUSTED", "RESOURCE_EXHAUSTED", "insufficient capacity", "resources are not available"}},
+	{failurePermissionDenied, []string{"PERMISSION_DENIED", "does not have permission", "UNAUTHENTICATED", "Reauthentication required"}},
+	{failurePreempted, []string{"PREEMPTED", "was preempted"}},
+	{failureNotFound, []string{"NOT_FOUND", "was not found"}},
+	{failureTransient, []string{"UNAVAILABLE", "DEADLINE_EXCEEDED", "Internal error", "try again", "temporarily", "TLS handshake timeout", "Error 502", "Error 503"}},
+}
+
+var sshPatterns = []failurePattern{
+	{failurePermissionDenied, []string{"Permission denied (publickey"}},
+	{failureHostKey, []string{"Host key verification failed", "REMOTE HOST IDENTIFICATION HAS CHANGED", "host key is known for"}},
+	{failureSshUnreachable, []string{"Connection refused", "Connection timed out", "No route to host", "Connection closed by", "Connection reset by", "kex_exchange_identification", "Could not resolve hostname"}},
+}
+
+type failurePattern struct {
+	kind     failureKind
+	patterns []string
+}
+
+// classify turns a failed command into a cloudError, from its exit code and stderr.
+// A non-zero exit from a remote command that did run is failureRemoteCommand, ssh itself exits 255.
+// Only the ssh client's own messages classify ssh, scp and rsync output.
+func classify(op string, kind string, err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	stderr = strings.TrimSpace(stderr)
+	detail := stderr
+	if detail == "" {
+		detail = err.Error()
+	}
+	e := &cloudError{message: fmt.Sprintf("error %s: %s", op, detail), exitCode: exitCode(err), err: err}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// a hung connection looks like this too, so not the remote command's fault
+		e.message = fmt.Sprintf("error %s: %s", op, err)
+		e.kind = failureTransient
+		if kind == "ssh" || kind == "rsync" || kind == "scp" {
+			e.kind = failureSshUnreachable
+		}
+		return e
+	}
+	if errors.Is(err, context.Canceled) {
+		e.message = fmt.Sprintf("error %s: %s", op, err)
+		return e
+	}
+	if kind == "ssh" && e.exitCode > 0 && e.exitCode != 255 {
+		// the remote command ran, whatever it printed is its own business
+		e.kind = failureRemoteCommand
+		e.message = fmt.Sprintf("error %s: exit %d: %s", op, e.exitCode, detail)
+		return e
+	}
+	e.kind = classifyOutput(kind, stderr)
+	if rateLimited(kind, stderr) {
+		e.kind = failureRateLimited
+	}
+	if e.kind != failureUnknown {
+		return e
+	}
+	switch {
+	case kind == "ssh" && e.exitCode == 255:
+		e.kind = failureSshUnreachable
+	case kind == "rsync" && (e.exitCode == 12 || e.exitCode == 255):
+		// the connection dropped or never came up
+		e.kind = failureSshUnreachable
+	}
+	return e
+}
+
+func classifyOutput(kind string, stderr string) failureKind {
+	patterns := sshPatterns
+	if !isSshKind(kind) {
+		patterns = append(cloudPatterns[:len(cloudPatterns):len(cloudPatterns)], sshPatterns...)
+	}
+	lower := strings.ToLower(stderr)
+	for _, class := range patterns {
+		for _, pattern := range class.patterns {
+			if strings.Contains(lower, strings.ToLower(pattern)) {
+				return class.kind
+			}
+		}
+	}
+	return failureUnknown
+}
+
+// rateLimited is the API pushing back on calls. Only a create can run out of TPUs,
+// RESOURCE_EXHAUSTED from anything else is about the calls themselves.
+func rateLimited(kind string, output string) bool {
+	if isSshKind(kind) {
+		return false
+	}
+	switch classifyOutput(kind, output) {
+	case failureRateLimited:
+		return true
+	case failureCapacityExhausted:
+		return kind != "create"
+	}
+	return false
+}
+
+func failureOf(err error) failureKind {
+	var e *cloudError
+	if errors.As(err, &e) {
+		return e.kind
+	}
+	return failureUnknown
+}
+
+// kindError restores a classified error that went over the control socket as a string.
+func kindError(message string, kind failureKind) error {
+	if message == "" {
+		return nil
+	}
+	return &cloudError{kind: kind, message: message}
+}
+
+// retryDelay is how long Watch waits before trying again after err.
+// attempt counts the failures in a row.
+func retryDelay(err error, attempt int) time.Duration {
+	switch failureOf(err) {
+	case failureQuotaExceeded, failureCapacityExhausted:
+		return min(30*time.Second<<min(attempt, 5), 10*time.Minute)
+	case failurePermissionDenied, failureHostKey:
+		return 2 * time.Minute
+	}
+	return 5 * time.Second
+}
+
+// withHint adds the remediation hint for err to a one-line rendering of it.
+func withHint(err error) string {
+	hint := failureOf(err).Hint()
+	if hint == "" {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s (%s)", err.Error(), hint)
+}
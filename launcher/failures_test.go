@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// exitStatusError stands in for *exec.ExitError.
+type exitStatusError int
+
+func (e exitStatusError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e exitStatusError) ExitCode() int { return int(e) }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		kind   string
+		err    error
+		stderr string
+		want   failureKind
+	}{
+		{"quota", "create", exitStatusError(1), "ERROR: (gcloud.compute.tpus.tpu-vm.create) QUOTA_EXCEEDED: Quota 'TPUV4_CORES' exceeded", failureQuotaExceeded},
+		{"rate limit mentions quota", "describe", exitStatusError(1), "Quota exceeded for quota metric 'Read requests' and limit 'Read requests per minute'", failureRateLimited},
+		{"out of TPUs on create", "create", exitStatusError(1), "RESOURCE_EXHAUSTED: There is no more capacity in the zone", failureCapacityExhausted},
+		{"resource exhausted on describe is the api", "describe", exitStatusError(1), "RESOURCE_EXHAUSTED: too many requests", failureRateLimited},
+		{"permission", "describe", exitStatusError(1), "PERMISSION_DENIED: Permission 'tpu.nodes.get' denied", failurePermissionDenied},
+		{"not found", "describe", exitStatusError(1), "NOT_FOUND: Resource 'raleigh-v3-0' was not found", failureNotFound},
+		{"preempted", "describe", exitStatusError(1), "the TPU was preempted", failurePreempted},
+		{"transient", "list", exitStatusError(1), "UNAVAILABLE: The service is currently unavailable", failureTransient},
+		{"nothing known", "describe", exitStatusError(1), "something odd", failureUnknown},
+		{"ssh unreachable", "ssh", exitStatusError(255), "ssh: connect to host 10.0.0.1 port 22: Connection refused", failureSshUnreachable},
+		{"ssh exits 255 quietly", "ssh", exitStatusError(255), "", failureSshUnreachable},
+		{"ssh key refused", "ssh", exitStatusError(255), "user@10.0.0.1: Permission denied (publickey).", failurePermissionDenied},
+		{"ssh host key", "ssh", exitStatusError(255), "Host key verification failed.", failureHostKey},
+		{"remote command", "ssh", exitStatusError(1), "Connection refused", failureRemoteCommand},
+		{"remote output isn't gcloud's", "scp", exitStatusError(1), "quota exceeded on /dev/sda", failureUnknown},
+		{"rsync connection dropped", "rsync", exitStatusError(12), "rsync error: error in rsync protocol data stream", failureSshUnreachable},
+		{"ssh timed out", "ssh", context.DeadlineExceeded, "", failureSshUnreachable},
+		{"gcloud timed out", "describe", context.DeadlineExceeded, "", failureTransient},
+		{"cancelled", "ssh", context.Canceled, "Connection refused", failureUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := classify("doing it", test.kind, test.err, test.stderr)
+			if got := failureOf(err); got != test.want {
+				t.Errorf("classify(%s, %q) = %s, want %s", test.kind, test.stderr, got, test.want)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("classify lost the original error: %v", err)
+			}
+		})
+	}
+	if err := classify("doing it", "ssh", nil, "Connection refused"); err != nil {
+		t.Errorf("classify of no error = %v, want nil", err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		kind   string
+		output string
+		want   bool
+	}{
+		{"describe", "HTTPError 429: Too Many Requests", true},
+		{"describe", "RESOURCE_EXHAUSTED", true},
+		{"create", "RESOURCE_EXHAUSTED", false},
+		{"create", "RATE_LIMIT_EXCEEDED", true},
+		{"describe", "QUOTA_EXCEEDED", false},
+		{"ssh", "HTTPError 429: Too Many Requests", false},
+		{"describe", "", false},
+	}
+	for _, test := range tests {
+		if got := rateLimited(test.kind, test.output); got != test.want {
+			t.Errorf("rateLimited(%s, %q) = %v, want %v", test.kind, test.output, got, test.want)
+		}
+	}
+}
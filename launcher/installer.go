@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -11,24 +12,38 @@ import (
 
 	"github.com/jdx/go-netrc"
 	"golang.org/x/mod/sumdb/dirhash"
-	"golang.org/x/net/context"
 )
 
 type TpuConfig struct {
-	repoPath         string
-	remoteRepoPath   string
-	zone             string
-	project          string
-	instanceType     string
-	numTpus          int
-	username         string
-	installCommand   string
-	tpuPrefix        string
-	installerVersion string
-	runCommand       string
-	spot             bool
-	preemptible      bool
-	numTpusActive    int
+	repoPath          string
+	remoteRepoPath    string
+	zone              string
+	project           string
+	instanceType      string
+	numTpus           int
+	username          string
+	installCommand    string
+	tpuPrefix         string
+	installerVersion  string
+	runCommand        string
+	spot              bool
+	preemptible       bool
+	numTpusActive     int
+	stopSignal        string
+	stopGracePeriod   time.Duration
+	stopTimeout       time.Duration
+	restartPolicy     restartPolicy
+	restartBackoff    time.Duration
+	restartBackoffMax time.Duration
+	maxRestarts       int
+	restartWindow     time.Duration
+	hangTimeout       time.Duration
+	stragglerSteps    int
+	probes            []probeConfig
+	metricsAddr       string
+	commandTimeout    time.Duration
+	provisionTimeout  time.Duration
+	installTimeout    time.Duration
 }
 
 type TpuInstaller struct {
@@ -40,53 +55,68 @@ type TpuInstaller struct {
 	repoCloned       bool
 	runningPid       int
 	raleighInfo      raleighInfo
+	stopStage        stopStage
+	lastExit         *exitStatus
+	heartbeat        *trainingMetrics
 }
 
-func NewTpuInstaller(cfg TpuConfig, id string) (*TpuInstaller, error) {
+func NewTpuInstaller(ctx context.Context, cfg TpuConfig, id string) (*TpuInstaller, error) {
 	installer := TpuInstaller{
-		tpuController: &TpuController{
-			project:      cfg.project,
-			zone:         cfg.zone,
-			instanceType: cfg.instanceType,
-			id:           id,
-			spot:         cfg.spot,
-			preemptible:  cfg.preemptible,
-		},
+		tpuController:    NewTpuController(cfg, id),
 		cfg:              cfg,
 		installerVersion: cfg.installerVersion,
 		runningPid:       -1,
 		raleighInfo:      raleighInfo{},
 	}
-	err := installer.UpdateStatus()
+	err := installer.UpdateStatus(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return &installer, nil
 }
 
-func (installer *TpuInstaller) UpdateStatus() error {
-	_, status := installer.tpuController.checkStatus()
+func (installer *TpuInstaller) UpdateStatus(ctx context.Context) error {
+	_, status := installer.tpuController.checkStatus(ctx)
 	if status == tpuStatusError {
+		if installer.tpuController.latestErr != nil {
+			return fmt.Errorf("error checking tpu status: %w", installer.tpuController.latestErr)
+		}
 		return fmt.Errorf("error checking tpu status")
 	}
 	if status == tpuStatusRunning {
-		basicsInstalled, err := installer.CheckBasicsInstalled()
+		if installer.tpuController.hostKeyErr != nil {
+			// strict host key checking would only fail every command below
+			return installer.tpuController.hostKeyErr
+		}
+		basicsInstalled, err := installer.CheckBasicsInstalled(ctx)
 		installer.basicsInstalled = basicsInstalled
 		if err != nil {
 			return fmt.Errorf("error checking basics installed: %w", err)
 		}
 
-		installer.repoClonedHash, installer.repoCloned, err = installer.CheckRepoCloned()
+		installer.repoClonedHash, installer.repoCloned, err = installer.CheckRepoCloned(ctx)
 		if err != nil {
 			return fmt.Errorf("error checking repo cloned: %w", err)
 		}
 
-		installer.runningPid, err = installer.CheckProcessRunning()
+		installer.runningPid, err = installer.CheckProcessRunning(ctx)
 		if err != nil {
 			return fmt.Errorf("error checking process running: %w", err)
 		}
 
-		installer.raleighInfo, err = installer.GetRaleighInfo()
+		if installer.runningPid == -1 {
+			installer.lastExit, err = installer.ReadExitStatus(ctx)
+			if err != nil {
+				return fmt.Errorf("error checking exit status: %w", err)
+			}
+		} else {
+			installer.heartbeat, err = installer.ReadHeartbeat(ctx)
+			if err != nil {
+				return fmt.Errorf("error checking heartbeat: %w", err)
+			}
+		}
+
+		installer.raleighInfo, err = installer.GetRaleighInfo(ctx)
 		if err != nil {
 			return fmt.Errorf("error getting raleigh info: %w", err)
 		}
@@ -97,27 +127,33 @@ func (installer *TpuInstaller) UpdateStatus() error {
 type catError struct {
 	code    int
 	message string
+	err     error
 }
 
 func (e *catError) Error() string {
 	return fmt.Sprintf("cat error: %d %s", e.code, e.message)
 }
 
+func (e *catError) Unwrap() error { return e.err }
+
 func (e *catError) IsNoFile() bool {
 	return strings.Contains(e.message, "No such file or directory")
 }
 
-func (t *TpuController) ReadFile(user string, path string) (string, *catError) {
-	cmd := t.ssh(user, "cat "+path)
+func (t *TpuController) ReadFile(ctx context.Context, user string, path string) (string, *catError) {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := t.ssh(ctx, user, "cat "+path)
 	stderr := bytes.Buffer{}
 	cmd.Stderr = &stderr
 	stdout := bytes.Buffer{}
 	cmd.Stdout = &stdout
-	cmd.Run()
-	if cmd.ProcessState.ExitCode() != 0 {
+	err := runCmd(ctx, "ssh", t.id, cmd)
+	if code := exitCode(err); code != 0 {
 		return "", &catError{
-			code:    cmd.ProcessState.ExitCode(),
+			code:    code,
 			message: stderr.String(),
+			err:     classify("reading "+path, "ssh", err, stderr.String()),
 		}
 	}
 	text := stdout.String()
@@ -125,8 +161,8 @@ func (t *TpuController) ReadFile(user string, path string) (string, *catError) {
 	return text, nil
 }
 
-func (t *TpuInstaller) CheckBasicsInstalled() (bool, error) {
-	version, err := t.tpuController.ReadFile(t.cfg.username, "~/.raleigh/install-version")
+func (t *TpuInstaller) CheckBasicsInstalled(ctx context.Context) (bool, error) {
+	version, err := t.tpuController.ReadFile(ctx, t.cfg.username, "~/.raleigh/install-version")
 	if err != nil {
 		if err.IsNoFile() {
 			return false, nil
@@ -139,19 +175,21 @@ func (t *TpuInstaller) CheckBasicsInstalled() (bool, error) {
 	return true, nil
 }
 
-func runCommand(t *TpuInstaller, command string) error {
-	cmd := t.tpuController.ssh(t.cfg.username, command)
+func runCommand(ctx context.Context, t *TpuInstaller, command string) error {
+	ctx, cancel := withTimeout(ctx, t.cfg.commandTimeout)
+	defer cancel()
+	cmd := t.tpuController.ssh(ctx, t.cfg.username, command)
 	stderr := bytes.Buffer{}
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error running command: %w: %s", err, stderr.String())
-	}
-	return nil
+	err := runCmd(ctx, "ssh", t.tpuController.id, cmd)
+	return classify("running command", "ssh", err, stderr.String())
 }
 
-func (t *TpuInstaller) InstallBasics() error {
-	err := runCommand(t, "curl -LsSf https://astral.sh/uv/install.sh | sh")
+func (t *TpuInstaller) InstallBasics(ctx context.Context) error {
+	// the install timeout covers all of it, the commands inside don't get their own
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.installTimeout)
+	defer cancel()
+	err := runCommand(ctx, t, "curl -LsSf https://astral.sh/uv/install.sh | sh")
 	if err != nil {
 		return err
 	}
@@ -173,7 +211,7 @@ func (t *TpuInstaller) InstallBasics() error {
 		if err != nil {
 			return fmt.Errorf("error writing netrc: %w", err)
 		}
-		err = t.tpuController.scp(tmpNetrcPath.Name(), "~/.netrc", t.cfg.username)
+		err = t.tpuController.scp(ctx, tmpNetrcPath.Name(), "~/.netrc", t.cfg.username)
 		if err != nil {
 			return fmt.Errorf("error scping netrc: %w", err)
 		}
@@ -183,7 +221,7 @@ func (t *TpuInstaller) InstallBasics() error {
 		}
 	}
 
-	err = runCommand(t, "mkdir -p ~/.raleigh && echo '"+t.installerVersion+"' > ~/.raleigh/install-version")
+	err = runCommand(ctx, t, "mkdir -p ~/.raleigh && echo '"+t.installerVersion+"' > ~/.raleigh/install-version")
 	if err != nil {
 		return fmt.Errorf("error writing install version: %w", err)
 	}
@@ -199,13 +237,13 @@ func (t *TpuInstaller) LocalRepoHash() (string, error) {
 	return dirHash, nil
 }
 
-func (t *TpuInstaller) CheckRepoCloned() (string, bool, error) {
+func (t *TpuInstaller) CheckRepoCloned(ctx context.Context) (string, bool, error) {
 	dirHash, err := t.LocalRepoHash()
 	if err != nil {
 		return "", false, fmt.Errorf("error hashing repo: %w", err)
 	}
 
-	readHash, catErr := t.tpuController.ReadFile(t.cfg.username, "~/.raleigh/repo-version")
+	readHash, catErr := t.tpuController.ReadFile(ctx, t.cfg.username, "~/.raleigh/repo-version")
 	if catErr != nil {
 		if catErr.IsNoFile() {
 			return "", false, nil
@@ -215,13 +253,15 @@ func (t *TpuInstaller) CheckRepoCloned() (string, bool, error) {
 	return readHash, dirHash == readHash, nil
 }
 
-func (t *TpuInstaller) CloneRepo() error {
-	err := t.tpuController.rsync(t.cfg.repoPath, t.cfg.remoteRepoPath, t.cfg.username)
+func (t *TpuInstaller) CloneRepo(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.installTimeout)
+	defer cancel()
+	err := t.tpuController.rsync(ctx, t.cfg.repoPath, t.cfg.remoteRepoPath, t.cfg.username)
 	if err != nil {
 		return fmt.Errorf("error cloning repo: %w", err)
 	}
 
-	err = runCommand(t, fmt.Sprintf("cd %s && %s", t.cfg.remoteRepoPath, t.cfg.installCommand))
+	err = runCommand(ctx, t, fmt.Sprintf("cd %s && %s", t.cfg.remoteRepoPath, t.cfg.installCommand))
 	if err != nil {
 		return fmt.Errorf("error syncing repo: %w", err)
 	}
@@ -231,7 +271,7 @@ func (t *TpuInstaller) CloneRepo() error {
 		return fmt.Errorf("error hashing repo: %w", err)
 	}
 
-	err = runCommand(t, "echo '"+dirHash+"' > ~/.raleigh/repo-version")
+	err = runCommand(ctx, t, "echo '"+dirHash+"' > ~/.raleigh/repo-version")
 	if err != nil {
 		return fmt.Errorf("error writing repo version: %w", err)
 	}
@@ -242,9 +282,9 @@ func (t *TpuInstaller) CloneRepo() error {
 	return nil
 }
 
-func (t *TpuInstaller) CheckProcessRunning() (int, error) {
+func (t *TpuInstaller) CheckProcessRunning(ctx context.Context) (int, error) {
 	pidFile := "~/.raleigh/running.pid"
-	pid, catErr := t.tpuController.ReadFile(t.cfg.username, pidFile)
+	pid, catErr := t.tpuController.ReadFile(ctx, t.cfg.username, pidFile)
 	if catErr != nil {
 		if catErr.IsNoFile() {
 			return -1, nil
@@ -255,6 +295,14 @@ func (t *TpuInstaller) CheckProcessRunning() (int, error) {
 	if err != nil {
 		return -1, fmt.Errorf("error parsing pid: %w", err)
 	}
+	running, err := t.tpuController.checkProcessRunning(ctx, pidInt)
+	if err != nil {
+		return -1, fmt.Errorf("error checking pid %d: %w", pidInt, err)
+	}
+	if !running {
+		// the pid file outlives the process, the exit status tells us how it ended
+		return -1, nil
+	}
 	return pidInt, nil
 }
 
@@ -270,8 +318,8 @@ func (r raleighInfo) IsReal() bool {
 	return r.GroupId > 0
 }
 
-func (t *TpuInstaller) GetRaleighInfo() (raleighInfo, error) {
-	info, catErr := t.tpuController.ReadFile(t.cfg.username, "~/.raleigh/hosts.json")
+func (t *TpuInstaller) GetRaleighInfo(ctx context.Context) (raleighInfo, error) {
+	info, catErr := t.tpuController.ReadFile(ctx, t.cfg.username, "~/.raleigh/hosts.json")
 	if catErr != nil {
 		if catErr.IsNoFile() {
 			return raleighInfo{}, nil
@@ -287,7 +335,7 @@ func (t *TpuInstaller) GetRaleighInfo() (raleighInfo, error) {
 	return infoParsed, nil
 }
 
-func (t *TpuInstaller) WriteRaleighInfo(info raleighInfo) error {
+func (t *TpuInstaller) WriteRaleighInfo(ctx context.Context, info raleighInfo) error {
 	infoJson, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("error marshalling hosts.json: %w", err)
@@ -301,7 +349,7 @@ func (t *TpuInstaller) WriteRaleighInfo(info raleighInfo) error {
 	if err != nil {
 		return fmt.Errorf("error writing temp file: %w", err)
 	}
-	err = t.tpuController.scp(tempFile.Name(), "~/.raleigh/hosts.json", t.cfg.username)
+	err = t.tpuController.scp(ctx, tempFile.Name(), "~/.raleigh/hosts.json", t.cfg.username)
 	if err != nil {
 		return fmt.Errorf("error scping hosts.json: %w", err)
 	}
@@ -309,27 +357,19 @@ func (t *TpuInstaller) WriteRaleighInfo(info raleighInfo) error {
 	if err != nil {
 		return fmt.Errorf("error removing temp file: %w", err)
 	}
+	t.raleighInfo = info
 	return nil
 }
 
-func debugprintf(format string, a ...any) {
-	debugFile, err := os.OpenFile("./debug.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		fmt.Printf("error opening debug file: %v\n", err)
-		return
-	}
-	defer debugFile.Close()
-	fmt.Fprintf(debugFile, format, a...)
-	debugFile.Sync()
-}
-
-func (t *TpuInstaller) GetTpuLockfileUser() []int {
-	cmd := t.tpuController.ssh(t.cfg.username, "fuser /tmp/libtpu_lockfile")
+func (t *TpuInstaller) GetTpuLockfileUser(ctx context.Context) []int {
+	ctx, cancel := withTimeout(ctx, t.cfg.commandTimeout)
+	defer cancel()
+	cmd := t.tpuController.ssh(ctx, t.cfg.username, "fuser /tmp/libtpu_lockfile")
 	stderr := bytes.Buffer{}
 	cmd.Stderr = &stderr
 	stdout := bytes.Buffer{}
 	cmd.Stdout = &stdout
-	err := cmd.Run()
+	err := runCmd(ctx, "ssh", t.tpuController.id, cmd)
 	if err != nil {
 		// fuser returns 1 if the file does not exist or is not locked
 		return []int{}
@@ -347,38 +387,38 @@ func (t *TpuInstaller) GetTpuLockfileUser() []int {
 	return pids
 }
 
-func (t *TpuInstaller) KillRunningProcess() error {
-	err := t.tpuController.killProcess(t.runningPid, 1*time.Second, context.Background())
+func (t *TpuInstaller) StartProcess(ctx context.Context) error {
+	// assumes that the process is not running
+	// even if it is, tpu lockfile will be removed
+
+	wrapper, err := os.CreateTemp("", "run.sh")
 	if err != nil {
-		return fmt.Errorf("error killing process: %w", err)
+		return fmt.Errorf("error creating temp file: %w", err)
 	}
-	users := t.GetTpuLockfileUser()
-	for _, user := range users {
-		err = t.tpuController.killProcess(user, 1*time.Second, context.Background())
-		if err != nil {
-			return fmt.Errorf("error killing tpu lockfile user: %w", err)
-		}
+	defer wrapper.Close()
+	_, err = fmt.Fprintf(wrapper, runWrapper, t.cfg.remoteRepoPath, shellQuote(t.cfg.runCommand), t.raleighInfo.GroupId, exitLogTailLines)
+	if err != nil {
+		return fmt.Errorf("error writing temp file: %w", err)
 	}
-	err = runCommand(t, "rm -f /tmp/libtpu_lockfile ~/.raleigh/running.pid")
+	err = t.tpuController.scp(ctx, wrapper.Name(), "~/.raleigh/run.sh", t.cfg.username)
 	if err != nil {
-		return fmt.Errorf("error removing pid file: %s", err)
+		return fmt.Errorf("error scping run.sh: %w", err)
+	}
+	err = os.Remove(wrapper.Name())
+	if err != nil {
+		return fmt.Errorf("error removing temp file: %w", err)
 	}
-	t.runningPid = -1
-	return nil
-}
-
-func (t *TpuInstaller) StartProcess() error {
-	// assumes that the process is not running
-	// even if it is, tpu lockfile will be removed
 
-	cmd := t.tpuController.ssh(t.cfg.username, fmt.Sprintf("cd %s && nohup %s > ~/.raleigh/nohup.log 2>&1 & echo $! > ~/.raleigh/running.pid", t.cfg.remoteRepoPath, t.cfg.runCommand))
+	startCtx, cancel := withTimeout(ctx, t.cfg.commandTimeout)
+	defer cancel()
+	cmd := t.tpuController.ssh(startCtx, t.cfg.username, "nohup bash ~/.raleigh/run.sh > ~/.raleigh/nohup.log 2>&1 & echo $! > ~/.raleigh/running.pid")
 	stderr := bytes.Buffer{}
 	cmd.Stderr = &stderr
-	err := cmd.Run()
+	err = runCmd(startCtx, "ssh", t.tpuController.id, cmd)
 	if err != nil {
-		return fmt.Errorf("error starting process: %s", stderr.String())
+		return classify("starting process", "ssh", err, stderr.String())
 	}
-	pid, err := t.CheckProcessRunning()
+	pid, err := t.CheckProcessRunning(ctx)
 	if err != nil {
 		return fmt.Errorf("error checking process running: %s", stderr.String())
 	}
@@ -389,8 +429,10 @@ func (t *TpuInstaller) StartProcess() error {
 	return nil
 }
 
-func (t *TpuInstaller) GetUnusedPorts(nPorts int) ([]int, error) {
-	cmd := t.tpuController.ssh(t.cfg.username, fmt.Sprintf(
+func (t *TpuInstaller) GetUnusedPorts(ctx context.Context, nPorts int) ([]int, error) {
+	ctx, cancel := withTimeout(ctx, t.cfg.commandTimeout)
+	defer cancel()
+	cmd := t.tpuController.ssh(ctx, t.cfg.username, fmt.Sprintf(
 		"~/.local/bin/uv run python -c 'import socket; sockets = [socket.socket() for _ in range(%d)]; [sock.bind((\"0.0.0.0\", 0)) for sock in sockets]; [print(sock.getsockname()[1]) for sock in sockets]'",
 		nPorts,
 	))
@@ -398,9 +440,9 @@ func (t *TpuInstaller) GetUnusedPorts(nPorts int) ([]int, error) {
 	cmd.Stderr = &stderr
 	stdout := bytes.Buffer{}
 	cmd.Stdout = &stdout
-	err := cmd.Run()
+	err := runCmd(ctx, "ssh", t.tpuController.id, cmd)
 	if err != nil {
-		return nil, fmt.Errorf("error getting unused ports: %s", stderr.String())
+		return nil, classify("getting unused ports", "ssh", err, stderr.String())
 	}
 	ports := []int{}
 	for _, port := range strings.Split(stdout.String(), "\n") {
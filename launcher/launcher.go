@@ -1,13 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/table"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -74,31 +76,7 @@ func (m model) View() string {
 	return m.list.View()
 }
 
-type GcloudAuth struct {
-	Account string `json:"account"`
-	Status  string `json:"status"`
-}
-
-func main() {
-	gcloudAuth, err := exec.Command("gcloud", "auth", "list", "--format", "json").Output()
-	if err != nil {
-		panic(fmt.Errorf("fatal error getting gcloud auth: %w", err))
-	}
-	var authList []GcloudAuth
-	err = json.Unmarshal(gcloudAuth, &authList)
-	if err != nil {
-		panic(fmt.Errorf("fatal error unmarshalling gcloud auth: %w", err))
-	}
-	hasActiveAuth := false
-	for _, auth := range authList {
-		if auth.Status == "ACTIVE" {
-			hasActiveAuth = true
-		}
-	}
-	if !hasActiveAuth {
-		exec.Command("gcloud", "auth", "login").Run()
-	}
-
+func loadConfig() error {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	if os.Getenv("IGNORE_LOCAL_CONFIG") != "1" {
@@ -107,18 +85,18 @@ func main() {
 	viper.AddConfigPath("/etc/raleigh/")
 	viper.AddConfigPath("$HOME/.raleigh")
 
-	err = viper.ReadInConfig()
+	err := viper.ReadInConfig()
 	if err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			fmt.Println("Config file not found; creating default config file")
+			fmt.Fprintln(os.Stderr, "Config file not found; creating default config file")
 			home_dir, err := os.UserHomeDir()
 			if err != nil {
-				panic(fmt.Errorf("fatal error getting home directory: %w", err))
+				return fmt.Errorf("error getting home directory: %w", err)
 			}
 			os.MkdirAll(fmt.Sprintf("%s/.raleigh", home_dir), 0755)
 			viper.SafeWriteConfigAs(fmt.Sprintf("%s/.raleigh/config.yaml", home_dir))
 		} else {
-			panic(fmt.Errorf("fatal error config file: %w", err))
+			return fmt.Errorf("error reading config file: %w", err)
 		}
 	}
 
@@ -135,12 +113,81 @@ func main() {
 	viper.SetDefault("installCommand", "~/.local/bin/uv sync")
 	viper.SetDefault("installerVersion", "0.0.1b")
 	viper.SetDefault("runCommand", "~/.local/bin/uv run ./train --raleigh_json ~/.raleigh/hosts.json")
+	viper.SetDefault("stopSignal", "TERM")
+	viper.SetDefault("stopGracePeriod", "30s")
+	viper.SetDefault("stopTimeout", "30s")
+	viper.SetDefault("restartPolicy", "always")
+	viper.SetDefault("restartBackoff", "10s")
+	viper.SetDefault("restartBackoffMax", "5m")
+	viper.SetDefault("maxRestarts", 5)
+	viper.SetDefault("restartWindow", "30m")
+	viper.SetDefault("hangTimeout", "20m")
+	viper.SetDefault("stragglerSteps", 50)
+	viper.SetDefault("metricsAddr", "")
+	// how long one remote command, creating or deleting a TPU, and installing may take
+	viper.SetDefault("commandTimeout", "2m")
+	viper.SetDefault("provisionTimeout", "20m")
+	viper.SetDefault("installTimeout", "30m")
+	// gcloud calls at once and per second, ssh sessions at once overall and per TPU; 0 is no limit
+	viper.SetDefault("apiConcurrency", 8)
+	viper.SetDefault("apiRate", 5)
+	viper.SetDefault("sshConcurrency", 32)
+	viper.SetDefault("sshPerHost", 3)
+	viper.SetDefault("authMode", "gcloud")
+	viper.SetDefault("authAccount", "")
+	viper.SetDefault("authKeyFile", "")
+	viper.SetDefault("impersonateServiceAccount", "")
+	viper.SetDefault("sshKeys", "metadata")
+	// empty means ~/.raleigh/logs
+	viper.SetDefault("logDir", "")
+	viper.SetDefault("logLevel", "info")
+	viper.SetDefault("tracing", "off")
+	viper.SetDefault("otlpEndpoint", "http://localhost:4318")
+	return nil
+}
+
+func main() {
+	err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(runCli(os.Args[1:]))
+	}
+	err = setupLogging("raleigh")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	err = setupTracing("raleigh")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	err = setupAudit("raleigh")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	setupLimits()
+	defer flushTraces()
+	err = setupAuth()
+	if err == nil {
+		err = checkCredentials(context.Background())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flushTraces()
+		os.Exit(exitError)
+	}
+
+	// cancelled when the UI quits, which stops the watchers and kills their remote commands
+	ctx, cancel := context.WithCancel(context.Background())
 
 	var m tea.Model
 
 	mUpToDate := upToDate(func() tea.Model { return m })
 	items := []list.Item{
-		menuItem{name: "Start", model: start(mUpToDate)},
+		menuItem{name: "Start", model: start(ctx, mUpToDate)},
 		menuItem{name: "Settings", model: settings(mUpToDate)},
 	}
 
@@ -159,54 +206,98 @@ func main() {
 
 	m = &model{list: l}
 
-	if viper.GetString("project") == "" {
-		m = selectProject(m)
+	// wrapped inside out: the project is picked first since zones and types depend on it
+	if viper.GetString("instanceType") == "" {
+		m = selectInstanceType(m)
 	}
 	if viper.GetString("region") == "" {
 		m = selectRegion(m)
 	}
-	if viper.GetString("instanceType") == "" {
-		m = selectInstanceType(m)
-	}
-
-	if os.Getenv("AUTORUN") == "1" {
-		m = start(m)
+	if viper.GetString("project") == "" {
+		m = selectProject(m)
 	}
 
-	if _, err := tea.NewProgram(ResizeWrapper{m}).Run(); err != nil {
+	_, err = tea.NewProgram(ResizeWrapper{m}).Run()
+	cancel()
+	waitCommands(2 * commandWaitDelay)
+	if err != nil {
 		fmt.Println("Error running program:", err)
+		flushTraces()
 		os.Exit(1)
 	}
 }
 
 type tpuStats struct {
-	numActive     int
-	numInstalled  int
-	numCloned     int
-	numRunning    int
-	latestError   error
-	latestErrorId int
+	numActive    int
+	numInstalled int
+	numCloned    int
+	numRunning   int
+	numReady     int
+	probes       []string
+	stopping     []string
+	stragglers   []string
+	compared     []int
+	budgets      []budgetUsage
+	restarts     restartSnapshot
+	recent       []event
+	nodes        []nodeSnapshot
+}
+
+type monitorMode int
+
+const (
+	monitorModeMain monitorMode = iota
+	monitorModeLogs
+	monitorModeMetrics
+	monitorModeTable
+	monitorModeDetail
+	monitorModeExec
+	monitorModeEvents
+	monitorModeWarnings
+)
+
+type monitorTick struct{}
+
+func monitorTickCmd() tea.Cmd {
+	return tea.Tick(500*time.Millisecond, func(time.Time) tea.Msg { return monitorTick{} })
 }
 
 type TpuLaunchMonitor struct {
 	watcher  *TpuWatcher
 	tpuStats tpuStats
 	viewport viewport.Model
+	mode     monitorMode
+	logView  logViewer
+	table    table.Model
+	detail   viewport.Model
+	detailId int
+	confirm  *pendingConfirm
+	execView execView
+	events   eventViewer
+	warnings warningsView
 }
 
 func listenTpuUpdates(watcher *TpuWatcher) tea.Cmd {
 	return func() tea.Msg {
-		update := <-watcher.updates
+		<-watcher.updates
+		fleet := watcher.Status()
 		numActive, numInstalled, numCloned, numRunning := 0, 0, 0, 0
-		latestError := error(nil)
-		latestErrorId := -1
-		if update.err != nil {
-			latestError = update.err
-			latestErrorId = update.id + 1
+		numReady := 0
+		probes := []string{}
+		stopping := []string{}
+		nodes := make([]nodeSnapshot, len(watcher.statuses))
+		// the main screen shows the last few things that went wrong
+		recent := []event{}
+		for _, e := range watcher.events.Events(-1) {
+			switch e.Kind {
+			case eventError, eventProcessExited, eventGroupDissolved:
+				recent = append(recent, e)
+			}
 		}
 		for i := range len(watcher.statuses) {
 			status := &watcher.statuses[i]
 			status.mutex.Lock()
+			nodes[i] = nodeSnapshot{status: status.status, events: watcher.events.Events(i)}
 			if status.status.status == tpuStatusRunning {
 				numActive++
 			}
@@ -219,15 +310,31 @@ func listenTpuUpdates(watcher *TpuWatcher) tea.Cmd {
 			if status.status.running {
 				numRunning++
 			}
+			if status.status.ready {
+				numReady++
+			}
+			if len(status.status.probes) > 0 {
+				probes = append(probes, fmt.Sprintf("%s: %s", tpuName(watcher.cfg, i), probesView(status.status.probes)))
+			}
+			if status.status.stopStage != stopStageNone && status.status.stopStage != stopStageStopped {
+				stopping = append(stopping, fmt.Sprintf("%s %s", tpuName(watcher.cfg, i), status.status.stopStage.describe(watcher.cfg.stopSignal)))
+			}
 			status.mutex.Unlock()
 		}
 		return tpuStats{
-			numActive:     numActive,
-			numInstalled:  numInstalled,
-			numCloned:     numCloned,
-			numRunning:    numRunning,
-			latestError:   latestError,
-			latestErrorId: latestErrorId,
+			numActive:    numActive,
+			numInstalled: numInstalled,
+			numCloned:    numCloned,
+			numRunning:   numRunning,
+			numReady:     numReady,
+			probes:       probes,
+			stopping:     stopping,
+			stragglers:   fleet.Stragglers,
+			compared:     fleet.Compared,
+			budgets:      fleet.Budgets,
+			restarts:     fleet.Restarts,
+			recent:       tail(recent, 5),
+			nodes:        nodes,
 		}
 	}
 }
@@ -241,21 +348,190 @@ func (t *TpuLaunchMonitor) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.WindowSizeMsg:
 		t.viewport.Width = msg.Width
 		t.viewport.Height = msg.Height - 6
+		t.logView.SetSize(msg.Width, msg.Height)
+		t.table.SetWidth(msg.Width)
+		t.table.SetHeight(max(msg.Height-2, 1))
+		t.detail.Width = msg.Width
+		t.detail.Height = max(msg.Height-1, 0)
+		t.execView.SetSize(msg.Width, msg.Height)
+		t.events.SetSize(msg.Width, msg.Height)
+		t.warnings.SetSize(msg.Width, msg.Height)
+		return t, nil
+
+	case execResult:
+		return t, t.execView.Update(msg)
+
+	case shellFinished:
+		if msg.err != nil {
+			t.viewport.SetContent(fmt.Sprintf("ssh: %v", msg.err))
+		}
 		return t, nil
 
 	case tea.KeyMsg:
+		if t.confirm != nil {
+			switch msg.String() {
+			case "y":
+				t.watcher.Command(t.confirm.id, t.confirm.action)
+				t.confirm = nil
+			case "n", "esc":
+				t.confirm = nil
+			case "ctrl+c":
+				return nil, tea.Quit
+			}
+			return t, nil
+		}
+		if t.mode == monitorModeExec {
+			switch msg.String() {
+			case "ctrl+c":
+				return nil, tea.Quit
+			case "esc":
+				t.execView.input.Blur()
+				t.mode = monitorModeMain
+				return t, nil
+			}
+			return t, t.execView.Update(msg)
+		}
+		if msg.String() == "!" && t.mode != monitorModeLogs && t.mode != monitorModeEvents && t.mode != monitorModeWarnings {
+			t.mode = monitorModeExec
+			return t, t.execView.Focus()
+		}
+		if t.mode == monitorModeTable || t.mode == monitorModeDetail {
+			id := t.table.Cursor()
+			if t.mode == monitorModeDetail {
+				id = t.detailId
+			}
+			if msg.String() == "s" {
+				return t, openShell(t.execView.ctx, t.watcher.cfg, id)
+			}
+			if action, ok := actionKeys[msg.String()]; ok {
+				if action.Destructive() {
+					t.confirm = &pendingConfirm{id: id, action: action}
+				} else {
+					t.watcher.Command(id, action)
+				}
+				return t, nil
+			}
+		}
+		if t.mode == monitorModeTable {
+			switch msg.String() {
+			case "q", "ctrl+c":
+				return nil, tea.Quit
+			case "esc", "t":
+				t.mode = monitorModeMain
+				return t, nil
+			case "enter":
+				t.mode = monitorModeDetail
+				t.detailId = t.table.Cursor()
+				t.refreshDetail()
+				t.detail.GotoTop()
+				return t, nil
+			}
+			var cmd tea.Cmd
+			t.table, cmd = t.table.Update(msg)
+			return t, cmd
+		}
+		if t.mode == monitorModeDetail {
+			switch msg.String() {
+			case "q", "ctrl+c":
+				return nil, tea.Quit
+			case "esc":
+				t.mode = monitorModeTable
+				return t, nil
+			}
+			var cmd tea.Cmd
+			t.detail, cmd = t.detail.Update(msg)
+			return t, cmd
+		}
+		if t.mode == monitorModeMetrics {
+			switch msg.String() {
+			case "q", "ctrl+c":
+				return nil, tea.Quit
+			case "esc", "m":
+				t.mode = monitorModeMain
+			}
+			return t, nil
+		}
+		if t.mode == monitorModeWarnings {
+			switch msg.String() {
+			case "q", "ctrl+c":
+				return nil, tea.Quit
+			case "esc", "w":
+				t.mode = monitorModeMain
+				return t, nil
+			}
+			var cmd tea.Cmd
+			t.warnings.viewport, cmd = t.warnings.viewport.Update(msg)
+			return t, cmd
+		}
+		if t.mode == monitorModeEvents {
+			switch msg.String() {
+			case "ctrl+c":
+				return nil, tea.Quit
+			case "esc":
+				if !t.events.searching {
+					t.mode = monitorModeMain
+					return t, nil
+				}
+			}
+			return t, t.events.Update(msg)
+		}
+		if t.mode == monitorModeLogs {
+			switch msg.String() {
+			case "ctrl+c":
+				return nil, tea.Quit
+			case "esc":
+				if !t.logView.searching {
+					t.mode = monitorModeMain
+					return t, nil
+				}
+			}
+			return t, t.logView.Update(msg)
+		}
 		switch keypress := msg.String(); keypress {
 		case "q", "ctrl+c":
 			return nil, tea.Quit
+		case "l":
+			t.mode = monitorModeLogs
+			t.logView.refresh()
+			return t, monitorTickCmd()
+		case "m":
+			t.mode = monitorModeMetrics
+			return t, monitorTickCmd()
+		case "t":
+			t.mode = monitorModeTable
+			return t, nil
+		case "e":
+			t.mode = monitorModeEvents
+			t.events.refresh()
+			return t, monitorTickCmd()
+		case "w":
+			t.mode = monitorModeWarnings
+			t.warnings.refresh()
+			t.warnings.viewport.GotoBottom()
+			return t, monitorTickCmd()
 		}
+	case monitorTick:
+		switch t.mode {
+		case monitorModeLogs:
+			t.logView.Update(msg)
+		case monitorModeEvents:
+			t.events.Update(msg)
+		case monitorModeWarnings:
+			t.warnings.refresh()
+		case monitorModeMetrics:
+		default:
+			return t, nil
+		}
+		return t, monitorTickCmd()
 	case tpuStats:
 		t.tpuStats = msg
-		if t.tpuStats.latestError != nil {
-			errorStr := fmt.Sprintf("Error: \"%s\" (TPU %d)", strings.ReplaceAll(t.tpuStats.latestError.Error(), "\n", "\\n"), t.tpuStats.latestErrorId)
-			t.viewport.SetContent(lipgloss.NewStyle().Width(t.viewport.Width).Render(errorStr))
-		} else {
-			t.viewport.SetContent("")
+		recent := make([]string, len(t.tpuStats.recent))
+		for i, e := range t.tpuStats.recent {
+			recent[i] = formatEvent(e, t.watcher.cfg)
 		}
+		t.viewport.SetContent(lipgloss.NewStyle().Width(t.viewport.Width).Render(strings.Join(recent, "\n")))
+		t.table.SetRows(statusRows(t.tpuStats.nodes, t.watcher.cfg))
+		t.refreshDetail()
 		return t, listenTpuUpdates(t.watcher)
 	}
 	var cmd tea.Cmd
@@ -263,20 +539,113 @@ func (t *TpuLaunchMonitor) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return t, cmd
 }
 
+func (t *TpuLaunchMonitor) refreshDetail() {
+	if t.detailId < len(t.tpuStats.nodes) {
+		t.detail.SetContent(renderNodeDetail(t.detailId, t.tpuStats.nodes[t.detailId], t.watcher.cfg))
+	}
+}
+
+func (t *TpuLaunchMonitor) actionLine(help string) string {
+	if t.confirm != nil {
+		return skewWarnStyle.Render(fmt.Sprintf("%s %s? (y/n)", t.confirm.action, tpuName(t.watcher.cfg, t.confirm.id)))
+	}
+	return logHelpStyle.Render(help + " • " + actionHelp)
+}
+
 func (t *TpuLaunchMonitor) View() string {
+	switch t.mode {
+	case monitorModeTable:
+		return t.table.View() + "\n" + t.actionLine("↑/↓ select • enter details • s ssh • ! run on all • esc back")
+	case monitorModeDetail:
+		return t.detail.View() + "\n" + t.actionLine("↑/↓ scroll • s ssh • ! run on all • esc back")
+	case monitorModeExec:
+		return t.execView.View()
+	case monitorModeLogs:
+		return t.logView.View()
+	case monitorModeEvents:
+		return t.events.View()
+	case monitorModeWarnings:
+		return t.warnings.View()
+	case monitorModeMetrics:
+		return titleStyle.Render("Training metrics") + "\n\n" +
+			renderMetrics(t.watcher.TrainingMetrics(), t.tpuStats.compared, t.viewport.Width, t.watcher.cfg) + "\n" +
+			logHelpStyle.Render("esc back")
+	}
 	builder := strings.Builder{}
 	builder.WriteString(lipgloss.NewStyle().Width(t.viewport.Width).Border(lipgloss.NormalBorder()).Padding(1).Render(t.viewport.View()))
 	statsStr := fmt.Sprintf("Active: %d, Installed: %d, Cloned: %d, Running: %d", t.tpuStats.numActive, t.tpuStats.numInstalled, t.tpuStats.numCloned, t.tpuStats.numRunning)
+	if len(t.watcher.cfg.probes) > 0 {
+		statsStr += fmt.Sprintf(", Ready: %d", t.tpuStats.numReady)
+		for _, line := range t.tpuStats.probes {
+			statsStr += "\n  " + line
+		}
+	}
+	if len(t.tpuStats.stopping) > 0 {
+		statsStr += "\nStopping: " + strings.Join(t.tpuStats.stopping, ", ")
+	}
+	if len(t.tpuStats.stragglers) > 0 {
+		statsStr += "\nStragglers: " + strings.Join(t.tpuStats.stragglers, ", ")
+	}
+	if len(t.tpuStats.budgets) > 0 {
+		budgets := make([]string, len(t.tpuStats.budgets))
+		for i, usage := range t.tpuStats.budgets {
+			budgets[i] = usage.String()
+		}
+		statsStr += "\nCommands: " + strings.Join(budgets, " • ")
+	}
+	statsStr += "\n" + t.tpuStats.restarts.View(t.watcher.cfg)
+	quit := "q quit"
+	if replay != nil {
+		statsStr += "\nReplaying a recorded session"
+	}
+	if t.watcher.remote != nil {
+		statsStr += fmt.Sprintf("\nAttached to the daemon started %s ago", formatAge(t.watcher.started))
+		quit = "q detach"
+	}
+	warningsHelp := "w warnings"
+	if unseen := t.warnings.unseen(); unseen > 0 {
+		warningsHelp = skewWarnStyle.Render(fmt.Sprintf("w warnings (%d new)", unseen))
+	}
+	statsStr += "\n" + logHelpStyle.Render("t nodes • l logs • e events • m metrics • ") + warningsHelp + logHelpStyle.Render(" • ! run on all • "+quit)
 	builder.WriteString(lipgloss.NewStyle().Width(t.viewport.Width).Border(lipgloss.NormalBorder()).Padding(1).Render(statsStr))
 	return builder.String()
 }
 
-func start(m tea.Model) tea.Model {
+// start watches the fleet until ctx is done, main cancels it once the UI quits.
+func start(ctx context.Context, m tea.Model) tea.Model {
 	return simpleSpinner(func() tea.Msg {
-		watcher := NewTpuWatcher(GetConfig())
+		// shells and commands from the UI connect directly, attached to a daemon or not
+		err := setupSsh(ctx, GetConfig())
+		if err != nil {
+			return spinnerError{err: errors.New(withHint(err))}
+		}
+		var watcher *TpuWatcher
+		if client := dialDaemon(); client != nil {
+			watcher, err = attachWatcher(ctx, client)
+			if err != nil {
+				return spinnerError{err: fmt.Errorf("error attaching to daemon: %w", err)}
+			}
+		} else {
+			cfg, err := GetRunConfig()
+			if err != nil {
+				return spinnerError{err: err}
+			}
+			// the preflight checks the project too
+			watcher, err = startWatcher(ctx, cfg)
+			if err != nil {
+				return spinnerError{err: err}
+			}
+		}
+		cfg := watcher.cfg
 
 		return &TpuLaunchMonitor{
-			watcher: watcher,
+			watcher:  watcher,
+			logView:  newLogViewer(watcher.logs),
+			table:    newStatusTable(),
+			detail:   viewport.New(0, 0),
+			execView: newExecView(ctx, cfg),
+			events:   newEventViewer(watcher.events, cfg),
+			warnings: newWarningsView(),
 		}
 	}, "Starting...")
 }
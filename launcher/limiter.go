@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Every command waits for its budget in runCmd. Control plane calls (describe, create, delete and
+// the gcloud listings) share one budget; create and delete wait for their turn under the rate but
+// don't keep a slot while the operation runs. ssh, scp and rsync take a slot on their host and one
+// from the ssh budget. Waiters are served round-robin across nodes, so a node with a lot to do
+// can't starve the others, and a throttled budget spaces its calls out until they succeed again.
+// Log streams and interactive shells hold their connection for good, they are not counted.
+
+const maxThrottledInterval = 30 * time.Second
+
+type budget struct {
+	name  string
+	limit int
+	// baseInterval is the configured spacing between calls, interval is what throttling made of it
+	baseInterval time.Duration
+
+	mutex   sync.Mutex
+	inUse   int
+	waiting map[string][]chan struct{}
+	// nodes with waiters, in the order they get their next slot
+	queue     []string
+	interval  time.Duration
+	nextStart time.Time
+	throttled int
+	// calls already in flight get throttled together, that counts as one slowdown
+	lastThrottled time.Time
+}
+
+func newBudget(name string, limit int, rate float64) *budget {
+	b := &budget{name: name, limit: limit, waiting: map[string][]chan struct{}{}}
+	if rate > 0 {
+		b.baseInterval = time.Duration(float64(time.Second) / rate)
+	}
+	b.interval = b.baseInterval
+	return b
+}
+
+// acquire waits for a slot and for the call's turn under the rate. Call release when done.
+func (b *budget) acquire(ctx context.Context, node string) error {
+	b.mutex.Lock()
+	if (b.limit <= 0 || b.inUse < b.limit) && len(b.queue) == 0 {
+		b.inUse++
+		b.mutex.Unlock()
+	} else {
+		ready := make(chan struct{})
+		if len(b.waiting[node]) == 0 {
+			b.queue = append(b.queue, node)
+		}
+		b.waiting[node] = append(b.waiting[node], ready)
+		b.mutex.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			if !b.cancelWait(node, ready) {
+				// the slot was handed over while we gave up
+				b.release()
+			}
+			return ctx.Err()
+		}
+	}
+
+	b.mutex.Lock()
+	start := time.Now()
+	if b.nextStart.After(start) {
+		start = b.nextStart
+	}
+	b.nextStart = start.Add(b.interval)
+	b.mutex.Unlock()
+	if wait := time.Until(start); wait > 0 {
+		select {
+		case <-ctx.Done():
+			b.release()
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return nil
+}
+
+func (b *budget) cancelWait(node string, ready chan struct{}) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	waiters := b.waiting[node]
+	for i, waiter := range waiters {
+		if waiter != ready {
+			continue
+		}
+		b.waiting[node] = append(waiters[:i:i], waiters[i+1:]...)
+		if len(b.waiting[node]) == 0 {
+			delete(b.waiting, node)
+			for j, queued := range b.queue {
+				if queued == node {
+					b.queue = append(b.queue[:j:j], b.queue[j+1:]...)
+					break
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// release hands the slot to the next node in line, which goes to the back of the line.
+func (b *budget) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.queue) == 0 {
+		b.inUse--
+		return
+	}
+	node := b.queue[0]
+	b.queue = b.queue[1:]
+	waiters := b.waiting[node]
+	close(waiters[0])
+	if len(waiters) > 1 {
+		b.waiting[node] = waiters[1:]
+		b.queue = append(b.queue, node)
+	} else {
+		delete(b.waiting, node)
+	}
+}
+
+// done adapts the spacing between calls: doubled when throttled, eased back after successes.
+func (b *budget) done(throttled bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if throttled {
+		b.throttled++
+		if time.Since(b.lastThrottled) < b.interval {
+			return
+		}
+		b.lastThrottled = time.Now()
+		b.interval = min(max(2*b.interval, 500*time.Millisecond), maxThrottledInterval)
+		// everyone waits, not just whoever calls next
+		b.nextStart = time.Now().Add(b.interval)
+		logger.Warn("throttled, slowing down", "budget", b.name, "interval", b.interval.String())
+		return
+	}
+	if b.interval > b.baseInterval {
+		b.interval = max(b.interval*9/10, b.baseInterval)
+	}
+}
+
+type budgetUsage struct {
+	Name    string `json:"name"`
+	InUse   int    `json:"in_use"`
+	Limit   int    `json:"limit"`
+	Waiting int    `json:"waiting"`
+	// Rate is the calls per second allowed right now, 0 without a limit
+	Rate      float64 `json:"rate,omitempty"`
+	Throttled int     `json:"throttled"`
+}
+
+func (b *budget) usage() budgetUsage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	usage := budgetUsage{Name: b.name, InUse: b.inUse, Limit: b.limit, Throttled: b.throttled}
+	for _, waiters := range b.waiting {
+		usage.Waiting += len(waiters)
+	}
+	if b.interval > 0 {
+		usage.Rate = float64(time.Second) / float64(b.interval)
+	}
+	return usage
+}
+
+func (u budgetUsage) String() string {
+	s := fmt.Sprintf("%s %d", u.Name, u.InUse)
+	if u.Limit > 0 {
+		s += fmt.Sprintf("/%d", u.Limit)
+	}
+	if u.Waiting > 0 {
+		s += fmt.Sprintf(", %d waiting", u.Waiting)
+	}
+	if u.Rate > 0 {
+		s += fmt.Sprintf(", %.1f/s", u.Rate)
+	}
+	if u.Throttled > 0 {
+		s += fmt.Sprintf(", throttled %d×", u.Throttled)
+	}
+	return s
+}
+
+type commandLimits struct {
+	api        *budget
+	ssh        *budget
+	sshPerHost int
+
+	mutex sync.Mutex
+	hosts map[string]*budget
+}
+
+// limits is nil until setupLimits, and then for replays, which keep their recorded timing.
+var limits *commandLimits
+
+func setupLimits() {
+	if replay != nil {
+		return
+	}
+	limits = &commandLimits{
+		api:        newBudget("api", viper.GetInt("apiConcurrency"), viper.GetFloat64("apiRate")),
+		ssh:        newBudget("ssh", viper.GetInt("sshConcurrency"), 0),
+		sshPerHost: viper.GetInt("sshPerHost"),
+		hosts:      map[string]*budget{},
+	}
+}
+
+func (l *commandLimits) host(node string) *budget {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.hosts[node]
+	if !ok {
+		b = newBudget(node, l.sshPerHost, 0)
+		l.hosts[node] = b
+	}
+	return b
+}
+
+// isLongRunningKind is a call that waits for its operation, which takes up to provisionTimeout.
+func isLongRunningKind(kind string) bool {
+	return kind == "create" || kind == "delete"
+}
+
+func isSshKind(kind string) bool {
+	return kind == "ssh" || kind == "scp" || kind == "rsync"
+}
+
+// acquire waits for the budgets a command of kind needs. finish takes what the command printed
+// on stderr if it failed, empty otherwise, and releases them.
+func (l *commandLimits) acquire(ctx context.Context, kind, node string) (finish func(output string), err error) {
+	if l == nil {
+		return func(string) {}, nil
+	}
+	if !isSshKind(kind) {
+		err = l.api.acquire(ctx, node)
+		if err != nil {
+			return nil, fmt.Errorf("%w while waiting for the api budget", err)
+		}
+		if isLongRunningKind(kind) {
+			// paced like any call, but holding a slot for the whole operation would leave
+			// nothing for describe while a fleet is being provisioned
+			l.api.release()
+			return func(output string) {
+				l.api.done(rateLimited(kind, output))
+			}, nil
+		}
+		return func(output string) {
+			l.api.done(rateLimited(kind, output))
+			l.api.release()
+		}, nil
+	}
+	// the host first, so a slot in the shared budget isn't held while the host is busy
+	host := l.host(node)
+	err = host.acquire(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("%w while waiting for an ssh slot on %s", err, node)
+	}
+	err = l.ssh.acquire(ctx, node)
+	if err != nil {
+		host.release()
+		return nil, fmt.Errorf("%w while waiting for the ssh budget", err)
+	}
+	return func(output string) {
+		host.done(sshThrottled(output))
+		l.ssh.release()
+		host.release()
+	}, nil
+}
+
+// Usage is the api and ssh budgets, with the per-host budgets counted into ssh.
+func (l *commandLimits) Usage() []budgetUsage {
+	if l == nil {
+		return nil
+	}
+	ssh := l.ssh.usage()
+	l.mutex.Lock()
+	hosts := make([]*budget, 0, len(l.hosts))
+	for _, host := range l.hosts {
+		hosts = append(hosts, host)
+	}
+	l.mutex.Unlock()
+	for _, host := range hosts {
+		usage := host.usage()
+		ssh.Waiting += usage.Waiting
+		ssh.Throttled += usage.Throttled
+	}
+	return []budgetUsage{l.api.usage(), ssh}
+}
+
+// sshThrottled is sshd turning connections away under MaxStartups.
+func sshThrottled(output string) bool {
+	return strings.Contains(output, "kex_exchange_identification") || strings.Contains(output, "ssh_exchange_identification")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// queue adds a waiter for node and waits until the budget sees it, so the order is known.
+func queue(t *testing.T, b *budget, ctx context.Context, node string, served chan<- string) {
+	t.Helper()
+	waiting := b.usage().Waiting
+	go func() {
+		if b.acquire(ctx, node) == nil {
+			served <- node
+		}
+	}()
+	for deadline := time.Now().Add(time.Second); b.usage().Waiting == waiting; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never started waiting", node)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBudgetRoundRobin(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued []string
+		want   []string
+	}{
+		{"one node", []string{"a", "a", "a"}, []string{"a", "a", "a"}},
+		{"busy node doesn't starve", []string{"a", "a", "a", "b"}, []string{"a", "b", "a", "a"}},
+		{"alternates", []string{"a", "a", "b", "b", "c"}, []string{"a", "b", "c", "a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBudget("test", 1, 0)
+			err := b.acquire(context.Background(), "holder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan string)
+			for _, node := range test.queued {
+				queue(t, b, context.Background(), node, served)
+			}
+			for i, want := range test.want {
+				b.release()
+				select {
+				case got := <-served:
+					if got != want {
+						t.Fatalf("slot %d went to %s, want %s", i, got, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("slot %d was never handed over", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBudgetCancelledWaiter(t *testing.T) {
+	b := newBudget("test", 1, 0)
+	err := b.acquire(context.Background(), "holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	queue(t, b, ctx, "a", served)
+	queue(t, b, context.Background(), "b", served)
+	cancel()
+	for deadline := time.Now().Add(time.Second); b.usage().Waiting != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled waiter is still queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.release()
+	if got := <-served; got != "b" {
+		t.Fatalf("slot went to %s, want b", got)
+	}
+	b.release()
+	if usage := b.usage(); usage.InUse != 0 || usage.Waiting != 0 {
+		t.Fatalf("usage after releasing everything = %+v", usage)
+	}
+}
+
+func TestBudgetThrottle(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		// t is a throttled call spaced out from the last one, T one right after it, s a success
+		calls         string
+		wantInterval  time.Duration
+		wantThrottled int
+	}{
+		{"no rate starts at the floor", 0, "t", 500 * time.Millisecond, 1},
+		{"fast rate starts at the floor", 10, "t", 500 * time.Millisecond, 1},
+		{"slow rate doubles", 0.5, "t", 4 * time.Second, 1},
+		{"doubles again", 0.5, "tt", 8 * time.Second, 2},
+		{"capped", 0.1, "ttt", maxThrottledInterval, 3},
+		{"calls in flight count once", 0.5, "tT", 4 * time.Second, 2},
+		{"eases back", 0, "ts", 450 * time.Millisecond, 1},
+		{"back to the configured rate", 10, "t" + "ssssssssssssssssssssssssssssss", 100 * time.Millisecond, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBudget("test", 0, test.rate)
+			for _, call := range test.calls {
+				switch call {
+				case 't':
+					b.lastThrottled = time.Time{}
+					b.done(true)
+				case 'T':
+					b.done(true)
+				case 's':
+					b.done(false)
+				}
+			}
+			if b.interval != test.wantInterval {
+				t.Errorf("interval = %s, want %s", b.interval, test.wantInterval)
+			}
+			if b.throttled != test.wantThrottled {
+				t.Errorf("throttled = %d, want %d", b.throttled, test.wantThrottled)
+			}
+		})
+	}
+}
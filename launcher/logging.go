@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	logMaxSize    = 10 << 20
+	logBackups    = 5
+	warningsLimit = 200
+)
+
+// logger is a no-op until setupLogging runs, nothing may ever write to the terminal under the TUI.
+var logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(value))
+	if err != nil {
+		return level, fmt.Errorf("not a level like debug, info, warn or error")
+	}
+	return level, nil
+}
+
+func logDir() (string, error) {
+	dir := viper.GetString("logDir")
+	if dir != "" {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".raleigh", "logs"), nil
+}
+
+// setupLogging sends JSON logs to <logDir>/<name>.log. The UI, the daemon and the
+// subcommands each get their own file so they never rotate each other's.
+func setupLogging(name string) error {
+	level, err := parseLogLevel(viper.GetString("logLevel"))
+	if err != nil {
+		return fmt.Errorf("error parsing logLevel: %w", err)
+	}
+	dir, err := logDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating log directory: %w", err)
+	}
+	file, err := openRotatingFile(filepath.Join(dir, name+".log"), logMaxSize, logBackups)
+	if err != nil {
+		return err
+	}
+	handler := slog.NewJSONHandler(file, &slog.HandlerOptions{Level: level})
+	logger = slog.New(&warningHandler{Handler: handler})
+	return nil
+}
+
+// rotatingFile starts over once it grows past maxSize, keeping name.1 … name.<backups>.
+type rotatingFile struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error opening log file: %w", err)
+	}
+	r.file = file
+	r.size = stat.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	err := os.Rename(r.path, r.path+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error rotating log file: %w", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+type warning struct {
+	at      time.Time
+	level   slog.Level
+	message string
+}
+
+func (w warning) String() string {
+	return fmt.Sprintf("%s %-5s %s", w.at.Format("15:04:05"), w.level, w.message)
+}
+
+// warningLog keeps the latest warnings and errors around for the TUI.
+type warningLog struct {
+	mutex    sync.Mutex
+	warnings []warning
+	total    int
+}
+
+var warnings = &warningLog{}
+
+func (l *warningLog) add(w warning) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.warnings = append(l.warnings, w)
+	if len(l.warnings) > warningsLimit {
+		l.warnings = l.warnings[len(l.warnings)-warningsLimit:]
+	}
+	l.total++
+}
+
+func (l *warningLog) Recent() ([]warning, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return slices.Clone(l.warnings), l.total
+}
+
+// warningHandler copies everything at warn and above into warnings before logging it.
+type warningHandler struct {
+	slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *warningHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		parts := []string{r.Message}
+		appendAttr := func(a slog.Attr) bool {
+			parts = append(parts, fmt.Sprintf("%s=%v", a.Key, a.Value))
+			return true
+		}
+		for _, a := range h.attrs {
+			appendAttr(a)
+		}
+		r.Attrs(appendAttr)
+		warnings.add(warning{at: r.Time, level: r.Level, message: strings.Join(parts, " ")})
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *warningHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &warningHandler{Handler: h.Handler.WithAttrs(attrs), attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h *warningHandler) WithGroup(name string) slog.Handler {
+	return &warningHandler{Handler: h.Handler.WithGroup(name), attrs: h.attrs}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxLogLines = 5000
+
+// longer lines are cut to this, the rest is skipped but still counted towards the offset
+const maxLogLineBytes = 1024 * 1024
+
+type logLine struct {
+	seq  uint64
+	node int
+	text string
+}
+
+type nodeLog struct {
+	mutex       sync.Mutex
+	lines       []logLine
+	groupId     int
+	offset      int64
+	file        *os.File
+	fileGroupId int
+	streaming   bool
+	lastLine    time.Time
+}
+
+// logHub follows ~/.raleigh/nohup.log on every node over a long-lived ssh session, keeps the
+// recent lines in memory for the TUI and copies everything into ~/.raleigh/runs/<group id>/logs.
+type logHub struct {
+	seq     atomic.Uint64
+	nodes   []*nodeLog
+	cfg     TpuConfig
+	metrics *metricsStore
+}
+
+func newLogHub(cfg TpuConfig, metrics *metricsStore) *logHub {
+	nodes := make([]*nodeLog, cfg.numTpus)
+	for i := range nodes {
+		nodes[i] = &nodeLog{fileGroupId: -1}
+	}
+	return &logHub{nodes: nodes, cfg: cfg, metrics: metrics}
+}
+
+// SetRun tells the hub which group the node's log belongs to. A new group truncates nohup.log,
+// so we start counting from the beginning of the file again.
+func (h *logHub) SetRun(id int, groupId int) {
+	node := h.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.groupId != groupId {
+		node.groupId = groupId
+		node.offset = 0
+	}
+}
+
+// Stream starts following the node's log if it isn't already being followed.
+func (h *logHub) Stream(ctx context.Context, id int, controller TpuController) {
+	node := h.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.streaming || replay != nil {
+		return
+	}
+	node.streaming = true
+	go h.follow(ctx, id, controller)
+}
+
+func (h *logHub) follow(ctx context.Context, id int, controller TpuController) {
+	node := h.nodes[id]
+	retry := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+			return true
+		}
+	}
+	for {
+		node.mutex.Lock()
+		offset := node.offset
+		node.mutex.Unlock()
+
+		// -c +N resumes where the previous session left off instead of replaying the whole log.
+		// tail -F never exits by itself, so the session is killed once reading stops
+		session, cancel := context.WithCancel(ctx)
+		cmd := controller.ssh(session, h.cfg.username, fmt.Sprintf("tail -c +%d -F ~/.raleigh/nohup.log 2>/dev/null", offset+1))
+		killProcessGroup(cmd)
+		cmd.WaitDelay = commandWaitDelay
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err != nil {
+			cancel()
+			logger.Warn("error starting log stream", "rank", id, "err", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		reader := bufio.NewReaderSize(stdout, 64*1024)
+		for {
+			text, size, err := readLogLine(reader)
+			if err != nil {
+				if err != io.EOF {
+					logger.Warn("error reading log stream", "rank", id, "err", err)
+				}
+				break
+			}
+			h.append(id, text, size)
+		}
+		cancel()
+		cmd.Wait()
+		if !retry() {
+			return
+		}
+	}
+}
+
+// readLogLine reads one line without its newline, cut to maxLogLineBytes. size is how many
+// bytes it took up in the log. A line the stream ended in the middle of is left for next time.
+func readLogLine(reader *bufio.Reader) (text string, size int64, err error) {
+	line := []byte{}
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		size += int64(len(chunk))
+		if len(line) < maxLogLineBytes {
+			line = append(line, chunk[:min(len(chunk), maxLogLineBytes-len(line))]...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		return strings.TrimSuffix(string(line), "\n"), size, nil
+	}
+}
+
+// append records a line that took up size bytes of the node's log.
+func (h *logHub) append(id int, text string, size int64) {
+	if metrics, ok := parseMetricsLine(text); ok {
+		h.metrics.Record(id, metrics)
+	}
+	node := h.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.offset += size
+	node.lastLine = time.Now()
+	node.lines = append(node.lines, logLine{seq: h.seq.Add(1), node: id, text: text})
+	if len(node.lines) > maxLogLines {
+		node.lines = node.lines[len(node.lines)-maxLogLines:]
+	}
+
+	if node.fileGroupId != node.groupId {
+		if node.file != nil {
+			node.file.Close()
+			node.file = nil
+		}
+		node.fileGroupId = node.groupId
+		runDir, err := localRunDir(node.groupId)
+		if err != nil {
+			logger.Warn("error opening local log", "rank", id, "group", node.groupId, "err", err)
+			return
+		}
+		err = os.MkdirAll(filepath.Join(runDir, "logs"), 0755)
+		if err != nil {
+			logger.Warn("error opening local log", "rank", id, "group", node.groupId, "err", err)
+			return
+		}
+		node.file, err = os.OpenFile(filepath.Join(runDir, "logs", tpuName(h.cfg, id)+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logger.Warn("error opening local log", "rank", id, "group", node.groupId, "err", err)
+			return
+		}
+	}
+	if node.file != nil {
+		fmt.Fprintln(node.file, text)
+	}
+}
+
+// ingest adds a line streamed by someone else, without parsing or saving it.
+func (h *logHub) ingest(line logLine) {
+	node := h.nodes[line.node]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.lastLine = time.Now()
+	node.lines = append(node.lines, line)
+	if len(node.lines) > maxLogLines {
+		node.lines = node.lines[len(node.lines)-maxLogLines:]
+	}
+}
+
+func (h *logHub) Lines(id int) []logLine {
+	node := h.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return append([]logLine{}, node.lines...)
+}
+
+func (h *logHub) LastLine(id int) time.Time {
+	node := h.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.lastLine
+}
+
+// Interleaved merges the recent lines of every node in the order they arrived.
+func (h *logHub) Interleaved() []logLine {
+	lines := []logLine{}
+	for id := range h.nodes {
+		lines = append(lines, h.Lines(id)...)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].seq < lines[j].seq })
+	return lines
+}
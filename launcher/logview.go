@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	logPrefixStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
+	logMatchStyle  = lipgloss.NewStyle().Reverse(true)
+	logHelpStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+)
+
+// logViewer shows the streamed log of one node, or of all nodes interleaved with node name prefixes.
+type logViewer struct {
+	logs      *logHub
+	node      int
+	all       bool
+	follow    bool
+	searching bool
+	search    textinput.Model
+	query     string
+	matches   []int
+	match     int
+	viewport  viewport.Model
+}
+
+func newLogViewer(logs *logHub) logViewer {
+	search := textinput.New()
+	search.Prompt = "/"
+	return logViewer{
+		logs:     logs,
+		follow:   true,
+		search:   search,
+		viewport: viewport.New(0, 0),
+	}
+}
+
+func (l *logViewer) SetSize(width, height int) {
+	l.viewport.Width = width
+	l.viewport.Height = max(height-2, 0)
+	l.refresh()
+}
+
+func (l *logViewer) refresh() {
+	var lines []logLine
+	if l.all {
+		lines = l.logs.Interleaved()
+	} else {
+		lines = l.logs.Lines(l.node)
+	}
+	rendered := make([]string, len(lines))
+	l.matches = l.matches[:0]
+	for i, line := range lines {
+		text := line.text
+		if l.query != "" && strings.Contains(text, l.query) {
+			l.matches = append(l.matches, i)
+			text = strings.ReplaceAll(text, l.query, logMatchStyle.Render(l.query))
+		}
+		if l.all {
+			text = logPrefixStyle.Render(fmt.Sprintf("[%s] ", tpuName(l.logs.cfg, line.node))) + text
+		}
+		rendered[i] = text
+	}
+	l.viewport.SetContent(strings.Join(rendered, "\n"))
+	if l.follow {
+		l.viewport.GotoBottom()
+	}
+}
+
+func (l *logViewer) jump(direction int) {
+	if len(l.matches) == 0 {
+		return
+	}
+	l.follow = false
+	l.match = posmod(l.match+direction, len(l.matches))
+	l.viewport.SetYOffset(l.matches[l.match])
+}
+
+func (l *logViewer) Update(msg tea.Msg) tea.Cmd {
+	switch msg := msg.(type) {
+	case monitorTick:
+		l.refresh()
+		return nil
+	case tea.KeyMsg:
+		if l.searching {
+			switch msg.String() {
+			case "enter":
+				l.searching = false
+				l.query = l.search.Value()
+				l.search.Blur()
+				l.refresh()
+				l.match = -1
+				l.jump(1)
+				return nil
+			case "esc":
+				l.searching = false
+				l.search.Blur()
+				return nil
+			}
+			var cmd tea.Cmd
+			l.search, cmd = l.search.Update(msg)
+			return cmd
+		}
+		switch msg.String() {
+		case "left", "h":
+			l.node = posmod(l.node-1, len(l.logs.nodes))
+			l.refresh()
+			return nil
+		case "right", "l":
+			l.node = posmod(l.node+1, len(l.logs.nodes))
+			l.refresh()
+			return nil
+		case "a":
+			l.all = !l.all
+			l.refresh()
+			return nil
+		case "f":
+			l.follow = !l.follow
+			l.refresh()
+			return nil
+		case "/":
+			l.searching = true
+			l.search.SetValue(l.query)
+			return l.search.Focus()
+		case "n":
+			l.jump(1)
+			return nil
+		case "N":
+			l.jump(-1)
+			return nil
+		case "up", "k", "pgup":
+			l.follow = false
+		}
+	}
+	var cmd tea.Cmd
+	l.viewport, cmd = l.viewport.Update(msg)
+	return cmd
+}
+
+func (l *logViewer) View() string {
+	builder := strings.Builder{}
+	title := "Logs: " + tpuName(l.logs.cfg, l.node)
+	if l.all {
+		title = "Logs: all nodes"
+	}
+	if l.follow {
+		title += " (following)"
+	}
+	if l.query != "" {
+		title += fmt.Sprintf(" [/%s: %d matches]", l.query, len(l.matches))
+	}
+	builder.WriteString(titleStyle.Render(title))
+	builder.WriteString("\n")
+	builder.WriteString(l.viewport.View())
+	builder.WriteString("\n")
+	if l.searching {
+		builder.WriteString(l.search.View())
+	} else {
+		builder.WriteString(logHelpStyle.Render("←/→ node • a all ranks • f follow • / search • n/N next/prev • esc back"))
+	}
+	return builder.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatPath     = "~/.raleigh/heartbeat.json"
+	metricsHistoryLen = 60
+)
+
+// trainingMetrics is what training reports, either by writing ~/.raleigh/heartbeat.json or by
+// logging a line like {"raleigh_metrics": {"step": 10, "loss": 2.5}}.
+type trainingMetrics struct {
+	Step         int64              `json:"step"`
+	Loss         float64            `json:"loss"`
+	TokensPerSec float64            `json:"tokens_per_sec"`
+	Demo         map[string]float64 `json:"demo"`
+	Time         float64            `json:"time"`
+}
+
+type metricsLogLine struct {
+	Metrics *trainingMetrics `json:"raleigh_metrics"`
+}
+
+func parseMetricsLine(text string) (trainingMetrics, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") || !strings.Contains(text, "raleigh_metrics") {
+		return trainingMetrics{}, false
+	}
+	line := metricsLogLine{}
+	err := json.Unmarshal([]byte(text), &line)
+	if err != nil || line.Metrics == nil {
+		return trainingMetrics{}, false
+	}
+	return *line.Metrics, true
+}
+
+func (t *TpuInstaller) ReadHeartbeat(ctx context.Context) (*trainingMetrics, error) {
+	text, catErr := t.tpuController.ReadFile(ctx, t.cfg.username, heartbeatPath)
+	if catErr != nil {
+		if catErr.IsNoFile() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading heartbeat: %w", catErr)
+	}
+	metrics := trainingMetrics{}
+	err := json.Unmarshal([]byte(text), &metrics)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling heartbeat: %w", err)
+	}
+	return &metrics, nil
+}
+
+type rankMetrics struct {
+	latest       trainingMetrics
+	updated      time.Time
+	loss         []float64
+	tokensPerSec []float64
+}
+
+// metricsStore collects training metrics per rank, from heartbeats and from the log streams.
+type metricsStore struct {
+	mutex sync.Mutex
+	ranks []rankMetrics
+}
+
+func newMetricsStore(numTpus int) *metricsStore {
+	return &metricsStore{ranks: make([]rankMetrics, numTpus)}
+}
+
+func appendHistory(history []float64, value float64) []float64 {
+	history = append(history, value)
+	if len(history) > metricsHistoryLen {
+		history = history[len(history)-metricsHistoryLen:]
+	}
+	return history
+}
+
+func (m *metricsStore) Record(id int, metrics trainingMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rank := &m.ranks[id]
+	if !rank.updated.IsZero() && metrics.Step == rank.latest.Step {
+		// heartbeats are re-read every few seconds, only a new step is news
+		return
+	}
+	if metrics.Step < rank.latest.Step {
+		// a new run started
+		rank.loss = nil
+		rank.tokensPerSec = nil
+	}
+	rank.latest = metrics
+	rank.updated = time.Now()
+	rank.loss = appendHistory(rank.loss, metrics.Loss)
+	rank.tokensPerSec = appendHistory(rank.tokensPerSec, metrics.TokensPerSec)
+}
+
+func (m *metricsStore) Snapshot() []rankMetrics {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	snapshot := make([]rankMetrics, len(m.ranks))
+	for i, rank := range m.ranks {
+		snapshot[i] = rank
+		snapshot[i].loss = append([]float64{}, rank.loss...)
+		snapshot[i].tokensPerSec = append([]float64{}, rank.tokensPerSec...)
+	}
+	return snapshot
+}
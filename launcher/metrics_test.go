@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetricsLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   trainingMetrics
+		wantOk bool
+	}{
+		{"step and loss", `{"raleigh_metrics": {"step": 10, "loss": 2.5}}`, trainingMetrics{Step: 10, Loss: 2.5}, true},
+		{"everything", `{"raleigh_metrics": {"step": 3, "loss": 1, "tokens_per_sec": 1200.5, "demo": {"norm": 0.1}, "time": 17.5}}`,
+			trainingMetrics{Step: 3, Loss: 1, TokensPerSec: 1200.5, Demo: map[string]float64{"norm": 0.1}, Time: 17.5}, true},
+		{"surrounding whitespace", "  {\"raleigh_metrics\": {\"step\": 1}}\r\n", trainingMetrics{Step: 1}, true},
+		{"other keys alongside", `{"level": "info", "raleigh_metrics": {"step": 2}}`, trainingMetrics{Step: 2}, true},
+		{"plain log line", "step 10 loss 2.5", trainingMetrics{}, false},
+		{"mentioned in text", "logging raleigh_metrics every step", trainingMetrics{}, false},
+		{"other json", `{"step": 10, "loss": 2.5}`, trainingMetrics{}, false},
+		{"null metrics", `{"raleigh_metrics": null}`, trainingMetrics{}, false},
+		{"cut off", `{"raleigh_metrics": {"step": 10, "lo`, trainingMetrics{}, false},
+		{"wrong type", `{"raleigh_metrics": {"step": "ten"}}`, trainingMetrics{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseMetricsLine(test.line)
+			if ok != test.wantOk || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseMetricsLine(%q) = %+v, %v, want %+v, %v", test.line, got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	skewWarnStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("214"))
+	skewAlertStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	lo, hi := slices.Min(values), slices.Max(values)
+	builder := strings.Builder{}
+	for _, v := range values {
+		i := 0
+		if hi > lo {
+			i = int(math.Round((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1)))
+		}
+		builder.WriteRune(sparkBlocks[i])
+	}
+	return builder.String()
+}
+
+func medianStep(ranks []rankMetrics, compared []int) int64 {
+	steps := []int64{}
+	for _, id := range compared {
+		if id < len(ranks) {
+			steps = append(steps, ranks[id].latest.Step)
+		}
+	}
+	if len(steps) == 0 {
+		return 0
+	}
+	slices.Sort(steps)
+	return steps[len(steps)/2]
+}
+
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1e6:
+		return fmt.Sprintf("%.1fM", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.1fk", rate/1e3)
+	}
+	return fmt.Sprintf("%.0f", rate)
+}
+
+// renderMetrics shows skew only for the compared ranks, see watchdog.Compared.
+func renderMetrics(ranks []rankMetrics, compared []int, width int, cfg TpuConfig) string {
+	builder := strings.Builder{}
+	median := medianStep(ranks, compared)
+	// loss and tokens/s trends share what's left of the line
+	nameWidth := max(len(tpuName(cfg, len(ranks)-1)), 4)
+	sparkWidth := max(min((width-55-nameWidth)/2, metricsHistoryLen), 10)
+	builder.WriteString(fmt.Sprintf("%-*s %-8s %-9s %-*s %-8s %-*s %-6s %s\n", nameWidth, "Node", "Step", "Loss", sparkWidth, "Loss trend", "Tok/s", sparkWidth, "Tok/s trend", "Skew", "Updated"))
+	for i, rank := range ranks {
+		if rank.updated.IsZero() {
+			builder.WriteString(fmt.Sprintf("%-*s %s\n", nameWidth, tpuName(cfg, i), logHelpStyle.Render("no metrics yet")))
+			continue
+		}
+		skew := rank.latest.Step - median
+		skewStr := fmt.Sprintf("%+d", skew)
+		switch {
+		case !slices.Contains(compared, i):
+			skewStr = fmt.Sprintf("%-6s", "-")
+		case skew <= -10:
+			skewStr = skewAlertStyle.Render(fmt.Sprintf("%-6s", skewStr))
+		case skew < 0:
+			skewStr = skewWarnStyle.Render(fmt.Sprintf("%-6s", skewStr))
+		default:
+			skewStr = fmt.Sprintf("%-6s", skewStr)
+		}
+		builder.WriteString(fmt.Sprintf("%-*s %-8d %-9.4f %-*s %-8s %-*s %s %s ago\n",
+			nameWidth, tpuName(cfg, i), rank.latest.Step, rank.latest.Loss, sparkWidth, sparkline(rank.loss, sparkWidth),
+			formatRate(rank.latest.TokensPerSec), sparkWidth, sparkline(rank.tokensPerSec, sparkWidth),
+			skewStr, time.Since(rank.updated).Round(time.Second)))
+	}
+
+	demoLines := []string{}
+	for i, rank := range ranks {
+		if len(rank.latest.Demo) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(rank.latest.Demo))
+		for key := range rank.latest.Demo {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		stats := make([]string, len(keys))
+		for j, key := range keys {
+			stats[j] = fmt.Sprintf("%s=%.4g", key, rank.latest.Demo[key])
+		}
+		demoLines = append(demoLines, fmt.Sprintf("  %s: %s", tpuName(cfg, i), strings.Join(stats, " ")))
+	}
+	if len(demoLines) > 0 {
+		builder.WriteString("\nDeMo\n")
+		builder.WriteString(strings.Join(demoLines, "\n"))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
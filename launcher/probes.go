@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type probeType string
+
+const (
+	probeCommand probeType = "command"
+	probeTCP     probeType = "tcp"
+	probeHTTP    probeType = "http"
+)
+
+type probeKind string
+
+const (
+	probeLiveness  probeKind = "liveness"
+	probeReadiness probeKind = "readiness"
+)
+
+// probeConfig is one entry of the `probes` list in the config file.
+type probeConfig struct {
+	Name             string        `mapstructure:"name"`
+	Kind             probeKind     `mapstructure:"kind"`
+	Type             probeType     `mapstructure:"type"`
+	Command          string        `mapstructure:"command"`
+	Port             int           `mapstructure:"port"`
+	Path             string        `mapstructure:"path"`
+	Interval         time.Duration `mapstructure:"interval"`
+	Timeout          time.Duration `mapstructure:"timeout"`
+	FailureThreshold int           `mapstructure:"failureThreshold"`
+}
+
+func getProbeConfigs() ([]probeConfig, error) {
+	probes := []probeConfig{}
+	err := viper.UnmarshalKey("probes", &probes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading probes: %w", err)
+	}
+	for i := range probes {
+		probe := &probes[i]
+		if probe.Name == "" {
+			probe.Name = fmt.Sprintf("probe-%d", i)
+		}
+		if probe.Kind != probeReadiness {
+			probe.Kind = probeLiveness
+		}
+		if probe.Interval <= 0 {
+			probe.Interval = 30 * time.Second
+		}
+		if probe.Timeout <= 0 {
+			probe.Timeout = 5 * time.Second
+		}
+		if probe.FailureThreshold <= 0 {
+			probe.FailureThreshold = 3
+		}
+		switch probe.Type {
+		case probeCommand:
+			if probe.Command == "" {
+				return nil, fmt.Errorf("probe %s: command probes need a command", probe.Name)
+			}
+		case probeTCP, probeHTTP:
+			if probe.Port <= 0 {
+				return nil, fmt.Errorf("probe %s: %s probes need a port", probe.Name, probe.Type)
+			}
+		default:
+			return nil, fmt.Errorf("probe %s: unknown type %q", probe.Name, probe.Type)
+		}
+	}
+	return probes, nil
+}
+
+// remoteCommand is run on the node itself, so ports don't need to be reachable from here.
+func (p probeConfig) remoteCommand() string {
+	seconds := max(int(p.Timeout.Seconds()), 1)
+	switch p.Type {
+	case probeTCP:
+		return fmt.Sprintf("timeout %d bash -c '</dev/tcp/127.0.0.1/%d'", seconds, p.Port)
+	case probeHTTP:
+		return fmt.Sprintf("curl -fsS -o /dev/null -m %d http://127.0.0.1:%d%s", seconds, p.Port, p.Path)
+	}
+	return fmt.Sprintf("timeout %d bash -c %s", seconds, shellQuote(p.Command))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+type probeResult struct {
+	name     string
+	kind     probeKind
+	ok       bool
+	failures int
+	checked  time.Time
+	message  string
+}
+
+func (r probeResult) failing(threshold int) bool {
+	return r.failures >= threshold
+}
+
+type nodeProbes struct {
+	mutex   sync.Mutex
+	active  bool
+	started bool
+	results []probeResult
+}
+
+// probeRunner runs the configured probes against every node that has a running process.
+type probeRunner struct {
+	cfg    TpuConfig
+	probes []probeConfig
+	nodes  []*nodeProbes
+}
+
+func newProbeRunner(cfg TpuConfig, probes []probeConfig) *probeRunner {
+	nodes := make([]*nodeProbes, cfg.numTpus)
+	for i := range nodes {
+		nodes[i] = &nodeProbes{}
+	}
+	return &probeRunner{cfg: cfg, probes: probes, nodes: nodes}
+}
+
+func (p *probeRunner) freshResults() []probeResult {
+	results := make([]probeResult, len(p.probes))
+	for i, probe := range p.probes {
+		results[i] = probeResult{name: probe.Name, kind: probe.Kind, message: "not checked yet"}
+	}
+	return results
+}
+
+// SetActive turns probing on and off with the node's process. A new process starts out unready.
+func (p *probeRunner) SetActive(id int, active bool) {
+	node := p.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if active && !node.active {
+		node.results = p.freshResults()
+	}
+	node.active = active
+}
+
+func (p *probeRunner) Start(ctx context.Context, id int, controller TpuController) {
+	node := p.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.started {
+		return
+	}
+	node.started = true
+	for i, probe := range p.probes {
+		go p.run(ctx, id, i, probe, controller)
+	}
+}
+
+func (p *probeRunner) run(ctx context.Context, id int, index int, probe probeConfig, controller TpuController) {
+	node := p.nodes[id]
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(probe.Interval):
+		}
+		node.mutex.Lock()
+		active := node.active
+		node.mutex.Unlock()
+		if !active {
+			continue
+		}
+
+		probeCtx, cancel := withTimeout(ctx, p.cfg.commandTimeout)
+		cmd := controller.ssh(probeCtx, p.cfg.username, probe.remoteCommand())
+		output := bytes.Buffer{}
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err := runCmd(probeCtx, "ssh", controller.id, cmd)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		node.mutex.Lock()
+		if node.active {
+			result := &node.results[index]
+			result.checked = time.Now()
+			result.ok = err == nil
+			if result.ok {
+				result.failures = 0
+				result.message = "ok"
+			} else {
+				result.failures++
+				result.message = strings.TrimSpace(output.String())
+				if result.message == "" {
+					result.message = err.Error()
+				}
+			}
+		}
+		node.mutex.Unlock()
+	}
+}
+
+func (p *probeRunner) Results(id int) []probeResult {
+	node := p.nodes[id]
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return append([]probeResult{}, node.results...)
+}
+
+// Ready is true once every readiness probe of the node passed since its process started.
+func (p *probeRunner) Ready(id int) bool {
+	for _, result := range p.Results(id) {
+		if result.kind == probeReadiness && !result.ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckLiveness returns an error if a liveness probe of the node failed failureThreshold times in a row.
+func (p *probeRunner) CheckLiveness(id int) error {
+	for i, result := range p.Results(id) {
+		if result.kind == probeLiveness && result.failing(p.probes[i].FailureThreshold) {
+			return fmt.Errorf("liveness probe %s failed %d times: %s", result.name, result.failures, result.message)
+		}
+	}
+	return nil
+}
+
+func probesView(results []probeResult) string {
+	parts := make([]string, len(results))
+	for i, result := range results {
+		switch {
+		case result.checked.IsZero():
+			parts[i] = result.name + " …"
+		case result.ok:
+			parts[i] = result.name + " ✓"
+		default:
+			parts[i] = fmt.Sprintf("%s ✗ (%d failures)", result.name, result.failures)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup keeps exec's default of killing just the process.
+func killProcessGroup(cmd *exec.Cmd) {}
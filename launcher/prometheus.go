@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var commandBuckets = []float64{0.5, 1, 2, 5, 10, 30, 60, 300}
+
+type commandStat struct {
+	count    int
+	failures int
+	seconds  float64
+	buckets  []int
+}
+
+// commandStats times every gcloud, ssh and rsync call the launcher makes.
+type commandStats struct {
+	mutex    sync.Mutex
+	commands map[string]*commandStat
+}
+
+var commandMetrics = &commandStats{commands: map[string]*commandStat{}}
+
+// observeCommand records one call. A remote command exiting non-zero is not an ssh failure,
+// only exit code 255 (ssh itself failed) is.
+func observeCommand(kind string, started time.Time, err error) {
+	seconds := time.Since(started).Seconds()
+	failed := err != nil
+	if kind == "ssh" && exitCode(err) > 0 && exitCode(err) != 255 {
+		failed = false
+	}
+	commandMetrics.mutex.Lock()
+	defer commandMetrics.mutex.Unlock()
+	stat, ok := commandMetrics.commands[kind]
+	if !ok {
+		stat = &commandStat{buckets: make([]int, len(commandBuckets))}
+		commandMetrics.commands[kind] = stat
+	}
+	stat.count++
+	stat.seconds += seconds
+	if failed {
+		stat.failures++
+	}
+	for i, bucket := range commandBuckets {
+		if seconds <= bucket {
+			stat.buckets[i]++
+		}
+	}
+}
+
+// promWriter writes the Prometheus text exposition format.
+type promWriter struct {
+	builder strings.Builder
+}
+
+func (p *promWriter) family(name, kind, help string) {
+	p.builder.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample takes label names and values in pairs.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.builder.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		p.builder.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	p.builder.WriteString(fmt.Sprintf(" %g\n", value))
+}
+
+func (p *promWriter) gauge(name, help string, value float64) {
+	p.family(name, "gauge", help)
+	p.sample(name, value)
+}
+
+func (p *promWriter) counter(name, help string, value float64) {
+	p.family(name, "counter", help)
+	p.sample(name, value)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeFleetMetrics(w io.Writer, watcher *TpuWatcher) {
+	p := promWriter{}
+	fleet := watcher.Status()
+	cfg := watcher.cfg
+
+	p.gauge("raleigh_tpus_configured", "Number of TPUs in the config.", float64(cfg.numTpus))
+	p.gauge("raleigh_tpus_active_target", "Number of TPUs a training group needs.", float64(cfg.numTpusActive))
+
+	states := map[string]int{}
+	for status := tpuStatusNonexistent; status <= tpuStatusError; status++ {
+		states[status.String()] = 0
+	}
+	installed, cloned, running, ready, cordoned := 0, 0, 0, 0, 0
+	for _, node := range fleet.Nodes {
+		states[node.status.String()]++
+		installed += int(boolFloat(node.installed))
+		cloned += int(boolFloat(node.cloned))
+		running += int(boolFloat(node.running))
+		ready += int(boolFloat(node.ready))
+		cordoned += int(boolFloat(node.cordoned))
+	}
+	p.family("raleigh_tpus", "gauge", "Number of TPUs per VM state.")
+	stateNames := make([]string, 0, len(states))
+	for state := range states {
+		stateNames = append(stateNames, state)
+	}
+	sort.Strings(stateNames)
+	for _, state := range stateNames {
+		p.sample("raleigh_tpus", float64(states[state]), "state", state)
+	}
+	p.gauge("raleigh_tpus_installed", "Number of TPUs with the basics installed.", float64(installed))
+	p.gauge("raleigh_tpus_cloned", "Number of TPUs with the current repo.", float64(cloned))
+	p.gauge("raleigh_tpus_running", "Number of TPUs running the training process.", float64(running))
+	p.gauge("raleigh_tpus_ready", "Number of TPUs passing their readiness probes.", float64(ready))
+	p.gauge("raleigh_tpus_cordoned", "Number of cordoned TPUs.", float64(cordoned))
+
+	p.family("raleigh_node_up", "gauge", "Whether the node runs the training process.")
+	for id, node := range fleet.Nodes {
+		p.sample("raleigh_node_up", boolFloat(node.running), "node", tpuName(cfg, id))
+	}
+
+	counts, preempted := watcher.events.Counts()
+	p.counter("raleigh_group_formations_total", "Training groups formed.", float64(counts[eventGroupFormed]))
+	p.counter("raleigh_group_dissolutions_total", "Training groups dissolved.", float64(counts[eventGroupDissolved]))
+	p.counter("raleigh_process_exits_total", "Training processes that exited.", float64(counts[eventProcessExited]))
+	p.counter("raleigh_errors_total", "Errors recorded in the event log.", float64(counts[eventError]))
+	p.counter("raleigh_preemptions_total", "TPUs seen in the PREEMPTED state.", float64(preempted))
+
+	p.counter("raleigh_restarts_total", "Group restarts.", float64(fleet.Restarts.restarts))
+	p.gauge("raleigh_crash_looping", "Whether restarts are held because of a crash loop.", boolFloat(fleet.Restarts.crashLooping))
+	p.family("raleigh_node_restarts_total", "counter", "Restarts caused by each node.")
+	for id, restarts := range fleet.Restarts.nodeRestarts {
+		p.sample("raleigh_node_restarts_total", float64(restarts), "node", tpuName(cfg, id))
+	}
+
+	p.family("raleigh_budget_in_use", "gauge", "Commands running under each budget.")
+	for _, usage := range fleet.Budgets {
+		p.sample("raleigh_budget_in_use", float64(usage.InUse), "budget", usage.Name)
+	}
+	p.family("raleigh_budget_waiting", "gauge", "Commands waiting for each budget.")
+	for _, usage := range fleet.Budgets {
+		p.sample("raleigh_budget_waiting", float64(usage.Waiting), "budget", usage.Name)
+	}
+	p.family("raleigh_budget_throttled_total", "counter", "Times each budget was throttled and slowed down.")
+	for _, usage := range fleet.Budgets {
+		p.sample("raleigh_budget_throttled_total", float64(usage.Throttled), "budget", usage.Name)
+	}
+
+	commandMetrics.mutex.Lock()
+	kinds := make([]string, 0, len(commandMetrics.commands))
+	for kind := range commandMetrics.commands {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	p.family("raleigh_command_duration_seconds", "histogram", "Duration of gcloud, ssh and rsync calls.")
+	for _, kind := range kinds {
+		stat := commandMetrics.commands[kind]
+		for i, bucket := range commandBuckets {
+			p.sample("raleigh_command_duration_seconds_bucket", float64(stat.buckets[i]), "command", kind, "le", fmt.Sprint(bucket))
+		}
+		p.sample("raleigh_command_duration_seconds_bucket", float64(stat.count), "command", kind, "le", "+Inf")
+		p.sample("raleigh_command_duration_seconds_sum", stat.seconds, "command", kind)
+		p.sample("raleigh_command_duration_seconds_count", float64(stat.count), "command", kind)
+	}
+	p.family("raleigh_command_failures_total", "counter", "Failed gcloud, ssh and rsync calls.")
+	for _, kind := range kinds {
+		p.sample("raleigh_command_failures_total", float64(commandMetrics.commands[kind].failures), "command", kind)
+	}
+	commandMetrics.mutex.Unlock()
+
+	training := watcher.TrainingMetrics()
+	p.family("raleigh_training_step", "gauge", "Latest training step reported by each node.")
+	for id, rank := range training {
+		if !rank.updated.IsZero() {
+			p.sample("raleigh_training_step", float64(rank.latest.Step), "node", tpuName(cfg, id))
+		}
+	}
+	p.family("raleigh_training_loss", "gauge", "Latest loss reported by each node.")
+	for id, rank := range training {
+		if !rank.updated.IsZero() {
+			p.sample("raleigh_training_loss", rank.latest.Loss, "node", tpuName(cfg, id))
+		}
+	}
+	p.family("raleigh_training_tokens_per_second", "gauge", "Latest throughput reported by each node.")
+	for id, rank := range training {
+		if !rank.updated.IsZero() {
+			p.sample("raleigh_training_tokens_per_second", rank.latest.TokensPerSec, "node", tpuName(cfg, id))
+		}
+	}
+	p.family("raleigh_training_heartbeat_age_seconds", "gauge", "Time since each node last reported a new step.")
+	for id, rank := range training {
+		if !rank.updated.IsZero() {
+			p.sample("raleigh_training_heartbeat_age_seconds", time.Since(rank.updated).Seconds(), "node", tpuName(cfg, id))
+		}
+	}
+
+	io.WriteString(w, p.builder.String())
+}
+
+func metricsHandler(watcher *TpuWatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeFleetMetrics(w, watcher)
+	}
+}
+
+// serveMetrics exposes /metrics on metricsAddr for a Prometheus to scrape.
+func serveMetrics(watcher *TpuWatcher) {
+	listener, err := net.Listen("tcp", watcher.cfg.metricsAddr)
+	if err != nil {
+		watcher.events.Error(-1, fmt.Errorf("error serving metrics: %w", err))
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler(watcher))
+	err = http.Serve(listener, mux)
+	if err != nil {
+		watcher.events.Error(-1, fmt.Errorf("error serving metrics: %w", err))
+	}
+}
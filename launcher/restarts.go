@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+type restartPolicy string
+
+const (
+	restartAlways    restartPolicy = "always"
+	restartOnFailure restartPolicy = "on-failure"
+	restartNever     restartPolicy = "never"
+)
+
+func restartPolicyFromString(s string) restartPolicy {
+	switch restartPolicy(strings.ToLower(strings.TrimSpace(s))) {
+	case restartOnFailure:
+		return restartOnFailure
+	case restartNever:
+		return restartNever
+	}
+	return restartAlways
+}
+
+// restartTracker is shared by all Watch goroutines. It decides whether a new group
+// may be launched after the previous one exited.
+type restartTracker struct {
+	mutex               sync.Mutex
+	cfg                 TpuConfig
+	groupId             int32
+	groupIsRestart      bool
+	everStarted         bool
+	totalRestarts       int
+	lastStart           time.Time
+	lastExit            time.Time
+	lastExitFailed      bool
+	exited              bool
+	consecutiveFailures int
+	restarts            []time.Time
+	crashLooping        bool
+	nodeRestarts        []int
+	nodeLastExit        []string
+	manual              bool
+}
+
+func newRestartTracker(cfg TpuConfig) *restartTracker {
+	return &restartTracker{
+		cfg:          cfg,
+		nodeRestarts: make([]int, cfg.numTpus),
+		nodeLastExit: make([]string, cfg.numTpus),
+	}
+}
+
+type restartHeldError struct {
+	reason string
+}
+
+func (e *restartHeldError) Error() string {
+	return "restart held: " + e.reason
+}
+
+func (r *restartTracker) backoff() time.Duration {
+	if r.consecutiveFailures == 0 {
+		return 0
+	}
+	backoff := r.cfg.restartBackoff
+	for i := 1; i < r.consecutiveFailures && backoff < r.cfg.restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, r.cfg.restartBackoffMax)
+}
+
+// CheckStart returns a *restartHeldError if a group launch should not happen right now.
+func (r *restartTracker) CheckStart() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.exited || r.manual {
+		return nil
+	}
+	if r.crashLooping {
+		return &restartHeldError{reason: fmt.Sprintf("crash loop: %d restarts in %s", len(r.restarts), r.cfg.restartWindow)}
+	}
+	switch r.cfg.restartPolicy {
+	case restartNever:
+		return &restartHeldError{reason: "restart policy is never"}
+	case restartOnFailure:
+		if !r.lastExitFailed {
+			return &restartHeldError{reason: "process exited successfully"}
+		}
+	}
+	wait := time.Until(r.lastExit.Add(r.backoff()))
+	if wait > 0 {
+		return &restartHeldError{reason: fmt.Sprintf("backing off for %s", wait.Round(time.Second))}
+	}
+	return nil
+}
+
+// RecordStart is called by every rank of a freshly launched group.
+func (r *restartTracker) RecordStart(groupId int32, id int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if groupId != r.groupId {
+		r.groupId = groupId
+		r.groupIsRestart = r.everStarted
+		r.everStarted = true
+		r.exited = false
+		r.manual = false
+		r.lastStart = time.Now()
+		if r.groupIsRestart {
+			r.totalRestarts++
+			r.restarts = append(r.restarts, r.lastStart)
+		}
+	}
+	if r.groupIsRestart {
+		r.nodeRestarts[id]++
+	}
+}
+
+// RecordExit is called by the ranks of a group that lost a process. Only the first call counts.
+func (r *restartTracker) RecordExit(failed bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.exited || !r.everStarted {
+		return
+	}
+	now := time.Now()
+	r.exited = true
+	r.lastExit = now
+	r.lastExitFailed = failed
+	if !failed || now.Sub(r.lastStart) > r.cfg.restartWindow {
+		// a run that lasted a whole window isn't part of a crash loop
+		r.consecutiveFailures = 0
+	}
+	if failed {
+		r.consecutiveFailures++
+	}
+
+	recent := r.restarts[:0]
+	for _, t := range r.restarts {
+		if now.Sub(t) <= r.cfg.restartWindow {
+			recent = append(recent, t)
+		}
+	}
+	r.restarts = recent
+	if r.cfg.maxRestarts > 0 && failed && len(r.restarts) >= r.cfg.maxRestarts {
+		r.crashLooping = true
+	}
+}
+
+// AllowRestart lets the next launch through regardless of policy, backoff or crash loop detection.
+func (r *restartTracker) AllowRestart() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.manual = true
+	r.crashLooping = false
+	r.consecutiveFailures = 0
+	r.restarts = nil
+}
+
+func (r *restartTracker) RecordNodeExit(id int, reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nodeLastExit[id] = reason
+}
+
+type restartSnapshot struct {
+	policy       restartPolicy
+	restarts     int
+	crashLooping bool
+	held         string
+	nodeRestarts []int
+	nodeLastExit []string
+}
+
+func (r *restartTracker) Snapshot() restartSnapshot {
+	held := ""
+	if err := r.CheckStart(); err != nil {
+		held = err.(*restartHeldError).reason
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return restartSnapshot{
+		policy:       r.cfg.restartPolicy,
+		restarts:     r.totalRestarts,
+		crashLooping: r.crashLooping,
+		held:         held,
+		nodeRestarts: append([]int{}, r.nodeRestarts...),
+		nodeLastExit: append([]string{}, r.nodeLastExit...),
+	}
+}
+
+func (s restartSnapshot) View(cfg TpuConfig) string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("Restarts: %d (policy: %s)", s.restarts, s.policy))
+	if s.crashLooping {
+		builder.WriteString(lipgloss.NewStyle().Foreground(lipgloss.Color("9")).Render(" CRASH LOOPING"))
+	}
+	if s.held != "" {
+		builder.WriteString(fmt.Sprintf(", %s", s.held))
+	}
+	for i := range s.nodeRestarts {
+		if s.nodeRestarts[i] == 0 && s.nodeLastExit[i] == "" {
+			continue
+		}
+		builder.WriteString(fmt.Sprintf("\n  %s: %d restarts", tpuName(cfg, i), s.nodeRestarts[i]))
+		if s.nodeLastExit[i] != "" {
+			builder.WriteString(fmt.Sprintf(", last exit: %s", s.nodeLastExit[i]))
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	cfg := TpuConfig{numTpus: 1, restartBackoff: 10 * time.Second, restartBackoffMax: time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{50, time.Minute},
+	}
+	for _, test := range tests {
+		r := newRestartTracker(cfg)
+		r.consecutiveFailures = test.failures
+		if got := r.backoff(); got != test.want {
+			t.Errorf("backoff after %d failures = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+func TestRestartCrashLoop(t *testing.T) {
+	cfg := TpuConfig{numTpus: 1, maxRestarts: 3, restartWindow: 10 * time.Minute}
+	tests := []struct {
+		name string
+		// how long ago the earlier restarts happened
+		restarts     []time.Duration
+		ranFor       time.Duration
+		failures     int
+		failed       bool
+		wantLooping  bool
+		wantFailures int
+		wantRestarts int
+	}{
+		{"first failure", nil, time.Minute, 0, true, false, 1, 0},
+		{"three quick restarts", []time.Duration{3 * time.Minute, 2 * time.Minute, time.Minute}, time.Minute, 2, true, true, 3, 3},
+		{"restarts spread out", []time.Duration{30 * time.Minute, 20 * time.Minute, time.Minute}, time.Minute, 2, true, false, 3, 1},
+		{"clean exit", []time.Duration{3 * time.Minute, 2 * time.Minute, time.Minute}, time.Minute, 2, false, false, 0, 3},
+		{"ran a whole window", []time.Duration{time.Minute}, 20 * time.Minute, 4, true, false, 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRestartTracker(cfg)
+			now := time.Now()
+			r.everStarted = true
+			r.lastStart = now.Add(-test.ranFor)
+			r.consecutiveFailures = test.failures
+			for _, ago := range test.restarts {
+				r.restarts = append(r.restarts, now.Add(-ago))
+			}
+			r.RecordExit(test.failed)
+			if r.crashLooping != test.wantLooping {
+				t.Errorf("crashLooping = %v, want %v", r.crashLooping, test.wantLooping)
+			}
+			if r.consecutiveFailures != test.wantFailures {
+				t.Errorf("consecutiveFailures = %d, want %d", r.consecutiveFailures, test.wantFailures)
+			}
+			if len(r.restarts) != test.wantRestarts {
+				t.Errorf("restarts in window = %d, want %d", len(r.restarts), test.wantRestarts)
+			}
+		})
+	}
+}
+
+func TestRestartCheckStart(t *testing.T) {
+	tests := []struct {
+		policy   restartPolicy
+		failed   bool
+		backoff  time.Duration
+		wantHeld bool
+	}{
+		{restartAlways, false, 0, false},
+		{restartAlways, true, 0, false},
+		{restartAlways, true, time.Hour, true},
+		{restartOnFailure, false, 0, true},
+		{restartOnFailure, true, 0, false},
+		{restartNever, true, 0, true},
+	}
+	for _, test := range tests {
+		cfg := TpuConfig{numTpus: 1, restartPolicy: test.policy, restartBackoff: test.backoff, restartBackoffMax: test.backoff, restartWindow: time.Minute}
+		r := newRestartTracker(cfg)
+		r.RecordStart(1, 0)
+		r.RecordExit(test.failed)
+		err := r.CheckStart()
+		if held := err != nil; held != test.wantHeld {
+			t.Errorf("%s policy, failed %v, backoff %s: held = %v (%v), want %v", test.policy, test.failed, test.backoff, held, err, test.wantHeld)
+		}
+		r.AllowRestart()
+		if err := r.CheckStart(); err != nil {
+			t.Errorf("%s policy: still held after AllowRestart: %v", test.policy, err)
+		}
+	}
+}
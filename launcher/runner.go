@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Every gcloud, ssh, scp and rsync call goes through runCmd, which waits for its budget, times it,
+// traces it, and writes it to the session's audit log. With RALEIGH_REPLAY pointing at an audit log,
+// runCmd plays the recorded results back instead of running anything.
+// Long-running streams (log tails, interactive shells) are not recorded.
+
+const (
+	commandOutputLimit = 16 << 10
+	auditSessions      = 50
+	// how long a cancelled command gets to close its output before it's abandoned
+	commandWaitDelay = 5 * time.Second
+)
+
+// localTimeout is for gcloud calls made before there is a TpuConfig, like listing projects.
+func localTimeout() (context.Context, context.CancelFunc) {
+	return withTimeout(context.Background(), viper.GetDuration("commandTimeout"))
+}
+
+// withTimeout bounds ctx by d, unless ctx already has a deadline of its own:
+// a whole operation's timeout wins over the timeouts of the commands inside it.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// runningCommands lets shutdown wait for cancelled commands to be killed and reaped.
+var runningCommands sync.WaitGroup
+
+// waitCommands waits up to timeout for in-flight commands to finish.
+func waitCommands(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		runningCommands.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+type commandRecord struct {
+	Seq      uint64    `json:"seq"`
+	Kind     string    `json:"kind"`
+	Node     string    `json:"node,omitempty"`
+	Args     []string  `json:"args"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	ExitCode int       `json:"exit_code"`
+	// Error is set when the command could not run at all
+	Error  string `json:"error,omitempty"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+var (
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key|access[_-]?key|private[_-]?key)[\w-]*\s*[=:]\s*)("[^"]*"|'[^']*'|[^\s'"]+)`),
+		regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)([^\s'"]+)`),
+		// netrc
+		regexp.MustCompile(`(?i)(\bpassword\s+)(\S+)`),
+	}
+	secretFlag = regexp.MustCompile(`(?i)^--?[\w-]*(password|secret|token|key)$`)
+)
+
+func redact(s string) string {
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllString(s, "${1}[REDACTED]")
+	}
+	return s
+}
+
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		if i > 0 && secretFlag.MatchString(args[i-1]) {
+			redacted[i] = "[REDACTED]"
+			continue
+		}
+		redacted[i] = redact(arg)
+	}
+	return redacted
+}
+
+// exitCode is the command's exit code, or -1 if it didn't get to run.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// cappedBuffer keeps the start and the end of a command's output.
+type cappedBuffer struct {
+	head    []byte
+	tail    []byte
+	dropped int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	half := commandOutputLimit / 2
+	if len(b.head) < half {
+		take := min(len(p), half-len(b.head))
+		b.head = append(b.head, p[:take]...)
+		p = p[take:]
+	}
+	b.tail = append(b.tail, p...)
+	if len(b.tail) > half {
+		b.dropped += len(b.tail) - half
+		b.tail = append([]byte{}, b.tail[len(b.tail)-half:]...)
+	}
+	return n, nil
+}
+
+func (b *cappedBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s\n[%d bytes truncated]\n%s", b.head, b.dropped, b.tail)
+	}
+	return string(b.head) + string(b.tail)
+}
+
+func capture(original io.Writer, buffer *cappedBuffer) io.Writer {
+	if original == nil {
+		return buffer
+	}
+	return io.MultiWriter(original, buffer)
+}
+
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+}
+
+var (
+	audit  *auditLog
+	replay *commandReplay
+)
+
+func auditDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".raleigh", "audit"), nil
+}
+
+// setupAudit starts ~/.raleigh/audit/<name>-<time>.jsonl, or loads the session to replay.
+func setupAudit(name string) error {
+	if path := os.Getenv("RALEIGH_REPLAY"); path != "" {
+		var err error
+		replay, err = loadReplay(path)
+		return err
+	}
+	dir, err := auditDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating audit directory: %w", err)
+	}
+	pruneAudit(dir)
+	file, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", name, time.Now().Format("20060102-150405"))), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	audit = &auditLog{file: file}
+	return nil
+}
+
+// pruneAudit keeps the latest sessions only.
+func pruneAudit(dir string) {
+	sessions, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(sessions) < auditSessions {
+		return
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		si, _ := os.Stat(sessions[i])
+		sj, _ := os.Stat(sessions[j])
+		return si != nil && sj != nil && si.ModTime().Before(sj.ModTime())
+	})
+	for _, session := range sessions[:len(sessions)-auditSessions+1] {
+		os.Remove(session)
+	}
+}
+
+func (a *auditLog) write(record commandRecord) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.seq++
+	record.Seq = a.seq
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		logger.Warn("error marshalling audit record", "err", err)
+		return
+	}
+	_, err = a.file.Write(append(recordJson, '\n'))
+	if err != nil {
+		logger.Warn("error writing audit log", "err", err)
+	}
+}
+
+// runCmd runs cmd on behalf of node, which is empty for commands that aren't about one TPU.
+// cmd should come from exec.CommandContext with ctx, so cancelling ctx kills it.
+func runCmd(ctx context.Context, kind, node string, cmd *exec.Cmd) error {
+	runningCommands.Add(1)
+	defer runningCommands.Done()
+	finish, err := limits.acquire(ctx, kind, node)
+	if err != nil {
+		return err
+	}
+	// with one writer for both, what the command said about failing is in Stdout
+	combined := false
+	record := commandRecord{Kind: kind, Node: node, Args: redactArgs(cmd.Args), Started: time.Now()}
+	ctx, span := childSpan(ctx, kind, "tpu", node, "command", commandSummary(record.Args))
+	if replay != nil {
+		err = replay.play(ctx, record, cmd)
+	} else {
+		// commands reading the terminal stay in its process group, so ctrl+c still reaches them
+		if cmd.Cancel != nil && cmd.Stdin == nil {
+			killProcessGroup(cmd)
+			cmd.WaitDelay = commandWaitDelay
+		}
+		stdout, stderr := &cappedBuffer{}, &cappedBuffer{}
+		if cmd.Stdout != nil && cmd.Stdout == cmd.Stderr {
+			combined = true
+			// one writer, so exec never writes to it from two goroutines
+			cmd.Stdout = capture(cmd.Stdout, stdout)
+			cmd.Stderr = cmd.Stdout
+		} else {
+			cmd.Stdout = capture(cmd.Stdout, stdout)
+			cmd.Stderr = capture(cmd.Stderr, stderr)
+		}
+		err = cmd.Run()
+		record.Stdout = redact(stdout.String())
+		record.Stderr = redact(stderr.String())
+	}
+	if err != nil && ctx.Err() != nil {
+		// killed, the exit status says nothing about the command
+		err = fmt.Errorf("%w after %s", ctx.Err(), time.Since(record.Started).Round(time.Second))
+	}
+	// only a failure says anything about the budget, and only stderr: stdout is whatever the
+	// command prints, a training log can mention rate limits too
+	throttleOutput := ""
+	if err != nil {
+		throttleOutput = record.Stderr
+		if combined {
+			throttleOutput = record.Stdout
+		}
+	}
+	finish(throttleOutput)
+	record.Ended = time.Now()
+	record.ExitCode = exitCode(err)
+	if err != nil && record.ExitCode == -1 {
+		record.Error = err.Error()
+	}
+	endSpan(span, err)
+	observeCommand(kind, record.Started, err)
+	audit.write(record)
+	return err
+}
+
+func outputCmd(ctx context.Context, kind, node string, cmd *exec.Cmd) ([]byte, error) {
+	stdout := bytes.Buffer{}
+	cmd.Stdout = &stdout
+	err := runCmd(ctx, kind, node, cmd)
+	return stdout.Bytes(), err
+}
+
+// commandSummary is what ran remotely for ssh, and the gcloud verb otherwise.
+func commandSummary(args []string) string {
+	// ssh [options] -- user@host command
+	if len(args) > 0 && filepath.Base(args[0]) == "ssh" {
+		for i, arg := range args {
+			if arg == "--" && i+2 < len(args) {
+				return args[i+2]
+			}
+		}
+	}
+	return strings.Join(args[:min(len(args), 5)], " ")
+}
+
+type replayedExit struct {
+	code int
+}
+
+func (e *replayedExit) Error() string { return fmt.Sprintf("exit status %d", e.code) }
+
+func (e *replayedExit) ExitCode() int { return e.code }
+
+// commandReplay hands out recorded results by command. The launcher polls, so once a command's
+// recordings run out its last result keeps being returned.
+type commandReplay struct {
+	mutex   sync.Mutex
+	pending map[string][]commandRecord
+	last    map[string]commandRecord
+}
+
+var (
+	tempPath = regexp.MustCompile(regexp.QuoteMeta(os.TempDir()) + `/[^\s\x00]+`)
+	// home directories, and wherever ~/.raleigh was on the recording machine (the ssh key and
+	// known_hosts go by absolute path)
+	homePath    = regexp.MustCompile(`(?:/home/[^/\s\x00]+|/Users/[^/\s\x00]+|/root)/`)
+	raleighPath = regexp.MustCompile(`[^\s=\x00]*/\.raleigh/`)
+)
+
+// replayKey leaves out temp file names, they differ between runs, and where the home directory
+// is, so a session recorded by someone else on another machine still plays back.
+func replayKey(kind, node string, args []string) string {
+	joined := tempPath.ReplaceAllString(strings.Join(args, "\x00"), "<temp>")
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		joined = strings.ReplaceAll(joined, homeDir+"/", "~/")
+	}
+	joined = homePath.ReplaceAllString(joined, "~/")
+	joined = raleighPath.ReplaceAllString(joined, "~/.raleigh/")
+	return kind + "\x00" + node + "\x00" + joined
+}
+
+func loadReplay(path string) (*commandReplay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening replay: %w", err)
+	}
+	defer file.Close()
+	r := &commandReplay{pending: map[string][]commandRecord{}, last: map[string]commandRecord{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*commandOutputLimit)
+	for scanner.Scan() {
+		var record commandRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("error reading replay: %w", err)
+		}
+		key := replayKey(record.Kind, record.Node, record.Args)
+		r.pending[key] = append(r.pending[key], record)
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("error reading replay: %w", scanner.Err())
+	}
+	return r, nil
+}
+
+func (r *commandReplay) play(ctx context.Context, record commandRecord, cmd *exec.Cmd) error {
+	key := replayKey(record.Kind, record.Node, record.Args)
+	r.mutex.Lock()
+	recorded, ok := r.last[key]
+	if queue := r.pending[key]; len(queue) > 0 {
+		recorded, ok = queue[0], true
+		r.pending[key] = queue[1:]
+		r.last[key] = recorded
+	}
+	r.mutex.Unlock()
+	if !ok {
+		logger.Warn("no recording to replay", "node", record.Node, "command", commandSummary(record.Args))
+		return fmt.Errorf("no recording of %s", strings.Join(record.Args, " "))
+	}
+
+	// keep the recorded timing, the watch loops depend on it
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(recorded.Ended.Sub(recorded.Started)):
+	}
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, recorded.Stdout)
+	}
+	if cmd.Stderr != nil && cmd.Stderr != cmd.Stdout {
+		io.WriteString(cmd.Stderr, recorded.Stderr)
+	}
+	if recorded.Error != "" {
+		return errors.New(recorded.Error)
+	}
+	if recorded.ExitCode != 0 {
+		return &replayedExit{code: recorded.ExitCode}
+	}
+	return nil
+}
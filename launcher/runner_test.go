@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"echo hello", "echo hello"},
+		{"WANDB_API_KEY=abc123 python train.py", "WANDB_API_KEY=[REDACTED] python train.py"},
+		{"export HF_TOKEN='hf_abc def'", "export HF_TOKEN=[REDACTED]"},
+		{`password: "hunter2" user: me`, `password: [REDACTED] user: me`},
+		{"secret_key = s3cr3t", "secret_key = [REDACTED]"},
+		{"curl -H 'Authorization: Bearer ya29.abc' https://example.com", "curl -H 'Authorization: Bearer [REDACTED]' https://example.com"},
+		{"machine api.wandb.ai login user password 0123abcd", "machine api.wandb.ai login user password [REDACTED]"},
+		{"keyboard layout", "keyboard layout"},
+	}
+	for _, test := range tests {
+		if got := redact(test.in); got != test.want {
+			t.Errorf("redact(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"gcloud", "compute", "tpus", "list"}, []string{"gcloud", "compute", "tpus", "list"}},
+		{[]string{"login", "--token", "abc"}, []string{"login", "--token", "[REDACTED]"}},
+		{[]string{"run", "--api-key", "abc", "--zone", "us-central1-a"}, []string{"run", "--api-key", "[REDACTED]", "--zone", "us-central1-a"}},
+		{[]string{"ssh", "host", "TOKEN=abc ./run.sh"}, []string{"ssh", "host", "TOKEN=[REDACTED] ./run.sh"}},
+		{[]string{"--token"}, []string{"--token"}},
+	}
+	for _, test := range tests {
+		if got := redactArgs(test.args); !slices.Equal(got, test.want) {
+			t.Errorf("redactArgs(%q) = %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestReplayKeyIgnoresHome(t *testing.T) {
+	args := func(home string) []string {
+		return []string{"ssh", "-i", home + "/.raleigh/ssh/id_ed25519", "-o", "UserKnownHostsFile=" + home + "/.raleigh/ssh/known_hosts", "user@10.0.0.1", "cat ~/.raleigh/running.pid"}
+	}
+	want := replayKey("ssh", "raleigh-v3-0", args("/home/alice"))
+	for _, home := range []string{"/home/bob", "/Users/carol", "/root", "/data/users/dave"} {
+		if got := replayKey("ssh", "raleigh-v3-0", args(home)); got != want {
+			t.Errorf("replay key with home %s = %q, want %q", home, got, want)
+		}
+	}
+	if replayKey("ssh", "raleigh-v3-1", args("/home/alice")) == want {
+		t.Error("replay key doesn't depend on the node")
+	}
+}
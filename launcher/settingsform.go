@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/viper"
+)
+
+var settingsLabelStyle = lipgloss.NewStyle().Width(20)
+
+// settingEffect is what it takes for a changed setting to reach the TPUs.
+type settingEffect int
+
+const (
+	effectNextStart settingEffect = iota
+	effectNextGroup
+	effectSync
+	effectReinstall
+	effectRedeploy
+)
+
+func (e settingEffect) String() string {
+	switch e {
+	case effectNextGroup:
+		return "applies to the next group formed, a running group keeps going; raleigh restart forms one now"
+	case effectSync:
+		return "reaches the TPUs on the next sync of a changed repo; raleigh sync --force syncs and installs now"
+	case effectReinstall:
+		return "every TPU is reinstalled"
+	case effectRedeploy:
+		return "needs a redeploy: VMs are created under the new names or count, old ones are not deleted"
+	}
+	return "applies the next time the launcher starts"
+}
+
+type settingKind int
+
+const (
+	settingText settingKind = iota
+	settingInt
+	settingPath
+	settingDuration
+)
+
+type settingField struct {
+	key    string
+	name   string
+	kind   settingKind
+	effect settingEffect
+	// check validates the value against the rest of the form, all values are as typed
+	check func(value string, values map[string]string) error
+}
+
+func positiveInt(value string, _ map[string]string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("not a number")
+	}
+	if n < 1 {
+		return fmt.Errorf("must be at least 1")
+	}
+	return nil
+}
+
+func nonNegativeInt(value string, _ map[string]string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("not a number")
+	}
+	if n < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	return nil
+}
+
+func nonEmpty(value string, _ map[string]string) error {
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validDuration(value string, _ map[string]string) error {
+	_, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("not a duration like 30s or 5m")
+	}
+	return nil
+}
+
+func existingDir(value string, _ map[string]string) error {
+	stat, err := os.Stat(value)
+	if err != nil {
+		return fmt.Errorf("does not exist")
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	return nil
+}
+
+var settingFields = []settingField{
+	{key: "numTpus", name: "TPUs", kind: settingInt, effect: effectRedeploy, check: positiveInt},
+	{key: "numTpusActive", name: "Active TPUs", kind: settingInt, effect: effectNextGroup, check: func(value string, values map[string]string) error {
+		err := positiveInt(value, values)
+		if err != nil {
+			return err
+		}
+		active, _ := strconv.Atoi(value)
+		total, err := strconv.Atoi(values["numTpus"])
+		if err == nil && active > total {
+			return fmt.Errorf("must not be more than the %d TPUs", total)
+		}
+		return nil
+	}},
+	{key: "tpuPrefix", name: "TPU name prefix", effect: effectRedeploy, check: nonEmpty},
+	{key: "username", name: "Username", effect: effectReinstall, check: nonEmpty},
+	{key: "installerVersion", name: "Installer version", effect: effectReinstall, check: nonEmpty},
+	{key: "repoPath", name: "Local repo", kind: settingPath, effect: effectSync, check: existingDir},
+	{key: "remoteRepoPath", name: "Remote repo", effect: effectSync, check: nonEmpty},
+	{key: "installCommand", name: "Install command", effect: effectSync, check: nonEmpty},
+	{key: "runCommand", name: "Run command", effect: effectNextGroup, check: nonEmpty},
+	{key: "stopSignal", name: "Stop signal", check: nonEmpty},
+	{key: "stopGracePeriod", name: "Stop grace period", kind: settingDuration, check: validDuration},
+	{key: "stopTimeout", name: "Stop timeout", kind: settingDuration, check: validDuration},
+	{key: "restartPolicy", name: "Restart policy", check: func(value string, _ map[string]string) error {
+		switch restartPolicy(value) {
+		case restartAlways, restartOnFailure, restartNever:
+			return nil
+		}
+		return fmt.Errorf("one of always, on-failure, never")
+	}},
+	{key: "restartBackoff", name: "Restart backoff", kind: settingDuration, check: validDuration},
+	{key: "restartBackoffMax", name: "Max restart backoff", kind: settingDuration, check: validDuration},
+	{key: "maxRestarts", name: "Max restarts", kind: settingInt, check: nonNegativeInt},
+	{key: "restartWindow", name: "Restart window", kind: settingDuration, check: validDuration},
+	{key: "hangTimeout", name: "Hang timeout", kind: settingDuration, check: validDuration},
+	{key: "stragglerSteps", name: "Straggler steps", kind: settingInt, check: nonNegativeInt},
+	{key: "commandTimeout", name: "Command timeout", kind: settingDuration, check: validDuration},
+	{key: "provisionTimeout", name: "Provision timeout", kind: settingDuration, check: validDuration},
+	{key: "installTimeout", name: "Install timeout", kind: settingDuration, check: validDuration},
+	{key: "apiConcurrency", name: "API concurrency", kind: settingInt, check: nonNegativeInt},
+	{key: "apiRate", name: "API calls per second", check: func(value string, _ map[string]string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("a number of calls per second, 0 for no limit")
+		}
+		return nil
+	}},
+	{key: "sshConcurrency", name: "SSH concurrency", kind: settingInt, check: nonNegativeInt},
+	{key: "sshPerHost", name: "SSH per TPU", kind: settingInt, check: nonNegativeInt},
+	{key: "metricsAddr", name: "Metrics address", check: func(value string, _ map[string]string) error {
+		if value == "" {
+			return nil
+		}
+		_, _, err := net.SplitHostPort(value)
+		if err != nil {
+			return fmt.Errorf("host:port like 127.0.0.1:9464, or empty to turn off")
+		}
+		return nil
+	}},
+	{key: "logDir", name: "Log directory", kind: settingPath, check: func(string, map[string]string) error { return nil }},
+	{key: "logLevel", name: "Log level", check: func(value string, _ map[string]string) error {
+		_, err := parseLogLevel(value)
+		return err
+	}},
+	{key: "tracing", name: "Tracing", check: func(value string, _ map[string]string) error {
+		switch value {
+		case "off", "file", "otlp":
+			return nil
+		}
+		return fmt.Errorf("one of off, file, otlp")
+	}},
+	{key: "otlpEndpoint", name: "OTLP endpoint", check: nonEmpty},
+	{key: "authMode", name: "Auth mode", check: validAuthMode},
+	{key: "authAccount", name: "Auth account", check: func(string, map[string]string) error { return nil }},
+	{key: "authKeyFile", name: "Auth key file", kind: settingPath, check: func(value string, _ map[string]string) error {
+		if value == "" {
+			return nil
+		}
+		path, err := expandHome(value)
+		if err != nil {
+			return err
+		}
+		_, err = readCredentialsFile(path)
+		return err
+	}},
+	{key: "impersonateServiceAccount", name: "Impersonate", check: func(string, map[string]string) error { return nil }},
+	{key: "sshKeys", name: "SSH keys", effect: effectNextStart, check: validSshKeyMode},
+}
+
+// settingsForm edits every plain config key at once. Nothing is written until the whole form is valid.
+type settingsForm struct {
+	back     tea.Model
+	inputs   []textinput.Model
+	original []string
+	errs     []error
+	focus    int
+	saveErr  error
+	// height is the terminal's, offset the first field shown when they don't all fit
+	height int
+	offset int
+}
+
+func editSettings(m tea.Model) tea.Model {
+	form := settingsForm{back: m}
+	for _, field := range settingFields {
+		input := textinput.New()
+		input.Prompt = ""
+		switch field.kind {
+		case settingInt:
+			input.Placeholder = "number"
+		case settingPath:
+			input.Placeholder = "path on this machine"
+		case settingDuration:
+			input.Placeholder = "duration, e.g. 30s"
+		}
+		input.SetValue(viper.GetString(field.key))
+		form.inputs = append(form.inputs, input)
+		form.original = append(form.original, input.Value())
+	}
+	form.errs = make([]error, len(settingFields))
+	form.inputs[0].Focus()
+	return &form
+}
+
+func (f *settingsForm) values() map[string]string {
+	values := map[string]string{}
+	for i, field := range settingFields {
+		values[field.key] = strings.TrimSpace(f.inputs[i].Value())
+	}
+	return values
+}
+
+func (f *settingsForm) validate() bool {
+	values := f.values()
+	valid := true
+	for i, field := range settingFields {
+		f.errs[i] = field.check(values[field.key], values)
+		if f.errs[i] != nil {
+			valid = false
+		}
+	}
+	return valid
+}
+
+func (f *settingsForm) save() error {
+	values := f.values()
+	for i, field := range settingFields {
+		value := values[field.key]
+		if value == f.original[i] {
+			continue
+		}
+		if field.kind == settingInt {
+			n, _ := strconv.Atoi(value)
+			viper.Set(field.key, n)
+		} else {
+			viper.Set(field.key, value)
+		}
+	}
+	err := viper.WriteConfig()
+	if err != nil {
+		return fmt.Errorf("error writing config: %w", err)
+	}
+	return nil
+}
+
+func (f *settingsForm) move(direction int) tea.Cmd {
+	f.inputs[f.focus].Blur()
+	f.focus = posmod(f.focus+direction, len(f.inputs))
+	return f.inputs[f.focus].Focus()
+}
+
+func (f *settingsForm) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (f *settingsForm) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		f.height = msg.Height
+		for i := range f.inputs {
+			f.inputs[i].Width = max(msg.Width-settingsLabelStyle.GetWidth()-4, 10)
+		}
+		return f, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c":
+			return f, tea.Quit
+		case "esc":
+			return f.back, f.back.Init()
+		case "tab", "down", "enter":
+			return f, f.move(1)
+		case "shift+tab", "up":
+			return f, f.move(-1)
+		case "ctrl+s":
+			if !f.validate() {
+				return f, nil
+			}
+			f.saveErr = f.save()
+			if f.saveErr != nil {
+				return f, nil
+			}
+			return f.back, f.back.Init()
+		}
+	}
+	var cmd tea.Cmd
+	f.inputs[f.focus], cmd = f.inputs[f.focus].Update(msg)
+	f.validate()
+	return f, cmd
+}
+
+func (f *settingsForm) View() string {
+	pending := f.pendingView()
+	// the title, the scroll markers and the help line take six lines
+	rows := len(settingFields)
+	if f.height > 0 {
+		rows = min(max(f.height-6-strings.Count(pending, "\n"), 3), rows)
+	}
+	f.offset = min(max(f.offset, f.focus-rows+1), f.focus)
+	f.offset = min(f.offset, len(settingFields)-rows)
+
+	builder := strings.Builder{}
+	builder.WriteString(titleStyle.Render("Settings"))
+	builder.WriteString("\n")
+	if f.offset > 0 {
+		builder.WriteString(logHelpStyle.Render(fmt.Sprintf("  ↑ %d more", f.offset)))
+	}
+	builder.WriteString("\n")
+	for i := f.offset; i < f.offset+rows; i++ {
+		cursor := "  "
+		if i == f.focus {
+			cursor = "> "
+		}
+		builder.WriteString(cursor + settingsLabelStyle.Render(settingFields[i].name) + f.inputs[i].View())
+		if f.errs[i] != nil {
+			builder.WriteString(" " + execFailStyle.Render(f.errs[i].Error()))
+		}
+		builder.WriteString("\n")
+	}
+	if below := len(settingFields) - f.offset - rows; below > 0 {
+		builder.WriteString(logHelpStyle.Render(fmt.Sprintf("  ↓ %d more", below)))
+	}
+	builder.WriteString("\n")
+	builder.WriteString(pending)
+	builder.WriteString("\n" + logHelpStyle.Render("tab/↓ next • shift+tab/↑ previous • ctrl+s save • esc discard"))
+	return builder.String()
+}
+
+func (f *settingsForm) pendingView() string {
+	builder := strings.Builder{}
+	builder.WriteString("Pending changes\n")
+	values := f.values()
+	changed := false
+	for i, field := range settingFields {
+		if values[field.key] == f.original[i] {
+			continue
+		}
+		changed = true
+		builder.WriteString(fmt.Sprintf("  %s: %s -> %s\n", field.key, execFailStyle.Render(f.original[i]), execOkStyle.Render(values[field.key])))
+		builder.WriteString(logHelpStyle.Render("    "+field.effect.String()) + "\n")
+	}
+	if !changed {
+		builder.WriteString("  none\n")
+	} else {
+		builder.WriteString(logHelpStyle.Render("  a running launcher keeps its settings until it is started again") + "\n")
+	}
+	if f.saveErr != nil {
+		builder.WriteString("\n" + execFailStyle.Render(f.saveErr.Error()) + "\n")
+	}
+	return builder.String()
+}
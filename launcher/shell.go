@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var (
+	execOkStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+	execFailStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+)
+
+type execResult struct {
+	// run is which command of the exec view this answers
+	run      int
+	id       int
+	output   string
+	exitCode int
+	err      error
+	duration time.Duration
+}
+
+// execOnNode runs a command on one node as the configured user and collects its output.
+// It has no timeout of its own, the command is the user's.
+func execOnNode(ctx context.Context, cfg TpuConfig, id int, command string) execResult {
+	controller := NewTpuController(cfg, tpuName(cfg, id))
+	cmd := controller.ssh(ctx, cfg.username, command)
+	output := bytes.Buffer{}
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	started := time.Now()
+	err := runCmd(ctx, "ssh", controller.id, cmd)
+	result := execResult{id: id, output: output.String(), duration: time.Since(started), exitCode: exitCode(err)}
+	if result.exitCode == -1 {
+		result.err = err
+	}
+	return result
+}
+
+type shellFinished struct {
+	err error
+}
+
+// openShell suspends the TUI and hands the terminal to an ssh session on the node.
+func openShell(ctx context.Context, cfg TpuConfig, id int) tea.Cmd {
+	if replay != nil {
+		return func() tea.Msg { return shellFinished{err: fmt.Errorf("not available while replaying")} }
+	}
+	controller := NewTpuController(cfg, tpuName(cfg, id))
+	return tea.ExecProcess(controller.interactiveSsh(ctx, cfg.username), func(err error) tea.Msg {
+		return shellFinished{err: err}
+	})
+}
+
+// execView is the "run on all nodes" prompt and its per-node results.
+type execView struct {
+	ctx      context.Context
+	cfg      TpuConfig
+	input    textinput.Model
+	command  string
+	results  []*execResult
+	viewport viewport.Model
+	// run counts the commands started, cancel stops the latest one
+	run    int
+	cancel context.CancelFunc
+}
+
+func newExecView(ctx context.Context, cfg TpuConfig) execView {
+	input := textinput.New()
+	input.Prompt = "run on all nodes $ "
+	return execView{ctx: ctx, cfg: cfg, input: input, viewport: viewport.New(0, 0)}
+}
+
+func (e *execView) SetSize(width, height int) {
+	e.viewport.Width = width
+	e.viewport.Height = max(height-2, 0)
+	e.refresh()
+}
+
+func (e *execView) Focus() tea.Cmd {
+	e.input.SetValue("")
+	return e.input.Focus()
+}
+
+func (e *execView) refresh() {
+	builder := strings.Builder{}
+	for id, result := range e.results {
+		name := tpuName(e.cfg, id)
+		switch {
+		case result == nil:
+			builder.WriteString(logPrefixStyle.Render(name) + " running…\n")
+			continue
+		case result.err != nil:
+			builder.WriteString(logPrefixStyle.Render(name) + " " + execFailStyle.Render(result.err.Error()))
+		case result.exitCode != 0:
+			builder.WriteString(logPrefixStyle.Render(name) + " " + execFailStyle.Render(fmt.Sprintf("exit %d", result.exitCode)))
+		default:
+			builder.WriteString(logPrefixStyle.Render(name) + " " + execOkStyle.Render("exit 0"))
+		}
+		builder.WriteString(fmt.Sprintf(" (%s)\n", result.duration.Round(100*time.Millisecond)))
+		builder.WriteString(result.output)
+		if !strings.HasSuffix(result.output, "\n") {
+			builder.WriteString("\n")
+		}
+	}
+	e.viewport.SetContent(builder.String())
+}
+
+func (e *execView) Update(msg tea.Msg) tea.Cmd {
+	switch msg := msg.(type) {
+	case execResult:
+		if msg.run != e.run {
+			// the answer to a command that has been replaced since
+			return nil
+		}
+		if msg.id < len(e.results) {
+			e.results[msg.id] = &msg
+		}
+		e.refresh()
+		return nil
+	case tea.KeyMsg:
+		if e.input.Focused() {
+			if msg.String() == "enter" && strings.TrimSpace(e.input.Value()) != "" {
+				e.command = e.input.Value()
+				e.input.Blur()
+				e.results = make([]*execResult, e.cfg.numTpus)
+				e.refresh()
+				if e.cancel != nil {
+					e.cancel()
+				}
+				e.run++
+				ctx, cancel := context.WithCancel(e.ctx)
+				e.cancel = cancel
+				cmds := make([]tea.Cmd, e.cfg.numTpus)
+				for id := range cmds {
+					command, cfg, run := e.command, e.cfg, e.run
+					cmds[id] = func() tea.Msg {
+						result := execOnNode(ctx, cfg, id, command)
+						result.run = run
+						return result
+					}
+				}
+				return tea.Batch(cmds...)
+			}
+			var cmd tea.Cmd
+			e.input, cmd = e.input.Update(msg)
+			return cmd
+		}
+		if msg.String() == "!" {
+			return e.Focus()
+		}
+	}
+	var cmd tea.Cmd
+	e.viewport, cmd = e.viewport.Update(msg)
+	return cmd
+}
+
+func (e *execView) View() string {
+	help := "↑/↓ scroll • ! new command • esc back"
+	if e.input.Focused() {
+		help = "enter run • esc back"
+	}
+	return e.input.View() + "\n" + e.viewport.View() + "\n" + logHelpStyle.Render(help)
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The launcher connects with its own key in ~/.raleigh/ssh, registered in the project's ssh-keys
+// metadata or with OS Login, and checks every TPU against the host keys the TPU published in its
+// guest attributes. Host keys are stored under an alias per TPU (HostKeyAlias), so a new IP doesn't
+// matter, and are fetched again when the TPU is recreated.
+
+type sshKeyMode string
+
+const (
+	// the key goes into the project's ssh-keys metadata, for username and root
+	sshKeysMetadata sshKeyMode = "metadata"
+	// the key goes into the account's OS Login profile, everything runs as its POSIX user
+	sshKeysOsLogin sshKeyMode = "oslogin"
+)
+
+func validSshKeyMode(value string, _ map[string]string) error {
+	switch sshKeyMode(value) {
+	case sshKeysMetadata, sshKeysOsLogin:
+		return nil
+	}
+	return fmt.Errorf("one of metadata, oslogin")
+}
+
+type sshAccess struct {
+	dir        string
+	keyPath    string
+	knownHosts string
+	// osLoginUser is who everything logs in as with OS Login, empty with metadata keys
+	osLoginUser string
+
+	mutex sync.Mutex
+	// the latest address of every TPU, by host key alias
+	addresses map[string]string
+	// the creation time of the TPU whose host keys are in known_hosts, by alias
+	hostKeys map[string]time.Time
+}
+
+// remoteAccess is set up by setupSsh before anything connects to a TPU.
+var remoteAccess *sshAccess
+
+func newSshAccess() (*sshAccess, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("error getting home directory: %w", err)
+	}
+	dir := filepath.Join(homeDir, ".raleigh", "ssh")
+	return &sshAccess{
+		dir:        dir,
+		keyPath:    filepath.Join(dir, "id_ed25519"),
+		knownHosts: filepath.Join(dir, "known_hosts"),
+		addresses:  map[string]string{},
+		hostKeys:   map[string]time.Time{},
+	}, nil
+}
+
+// sshRegistration is what was registered last, so a start doesn't need to ask the project again.
+type sshRegistration struct {
+	Mode        sshKeyMode `json:"mode"`
+	Project     string     `json:"project"`
+	Users       []string   `json:"users,omitempty"`
+	PublicKey   string     `json:"public_key"`
+	OsLoginUser string     `json:"os_login_user,omitempty"`
+}
+
+// setupSsh makes sure the launcher's key exists and is registered for the users it connects as.
+func setupSsh(ctx context.Context, cfg TpuConfig) error {
+	access, err := newSshAccess()
+	if err != nil {
+		return err
+	}
+	if replay != nil {
+		// the recorded commands already carry the key and known_hosts paths
+		remoteAccess = access
+		return nil
+	}
+	err = os.MkdirAll(access.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", access.dir, err)
+	}
+	publicKey, err := access.ensureKey(ctx)
+	if err != nil {
+		return err
+	}
+	mode := sshKeyMode(viper.GetString("sshKeys"))
+	wanted := sshRegistration{Mode: mode, Project: cfg.project, PublicKey: publicKey}
+	if mode == sshKeysMetadata {
+		wanted.Users = []string{cfg.username, "root"}
+	}
+	registrationPath := filepath.Join(access.dir, "registered.json")
+	var registered sshRegistration
+	data, err := os.ReadFile(registrationPath)
+	if err == nil && json.Unmarshal(data, &registered) == nil &&
+		registered.Mode == wanted.Mode && registered.Project == wanted.Project &&
+		registered.PublicKey == wanted.PublicKey && slices.Equal(registered.Users, wanted.Users) {
+		access.osLoginUser = registered.OsLoginUser
+		remoteAccess = access
+		return nil
+	}
+
+	switch mode {
+	case sshKeysMetadata:
+		err = registerMetadataKey(ctx, cfg, publicKey, wanted.Users)
+	case sshKeysOsLogin:
+		wanted.OsLoginUser, err = access.registerOsLoginKey(ctx, cfg, publicKey)
+	default:
+		err = validSshKeyMode(string(mode), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("error registering ssh key: %w", err)
+	}
+	access.osLoginUser = wanted.OsLoginUser
+	remoteAccess = access
+	data, err = json.Marshal(wanted)
+	if err == nil {
+		err = os.WriteFile(registrationPath, data, 0600)
+	}
+	if err != nil {
+		logger.Warn("error saving ssh key registration", "err", err)
+	}
+	return nil
+}
+
+// ensureKey generates the keypair on first use and returns the public key.
+func (a *sshAccess) ensureKey(ctx context.Context) (string, error) {
+	_, err := os.Stat(a.keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		hostname, _ := os.Hostname()
+		_, err = localOutput(ctx, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "raleigh@"+hostname, "-f", a.keyPath)
+		if err != nil {
+			return "", fmt.Errorf("error generating ssh key: %w", err)
+		}
+		logger.Info("generated ssh key", "path", a.keyPath)
+	}
+	publicKey, err := os.ReadFile(a.keyPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("error reading ssh public key: %w", err)
+	}
+	return strings.TrimSpace(string(publicKey)), nil
+}
+
+// registerMetadataKey adds user:key lines to the project's ssh-keys, keeping everyone else's.
+func registerMetadataKey(ctx context.Context, cfg TpuConfig, publicKey string, users []string) error {
+	ctx, cancel := withTimeout(ctx, cfg.commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "project-info", "describe", "--project", cfg.project, "--format", "json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := outputCmd(ctx, "gcloud", "", cmd)
+	if err != nil {
+		return classify("reading project metadata", "gcloud", err, stderr.String())
+	}
+	var project struct {
+		CommonInstanceMetadata struct {
+			Items []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"items"`
+		} `json:"commonInstanceMetadata"`
+	}
+	err = json.Unmarshal(output, &project)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling project metadata: %w", err)
+	}
+	lines := []string{}
+	for _, item := range project.CommonInstanceMetadata.Items {
+		if item.Key != "ssh-keys" {
+			continue
+		}
+		for _, line := range strings.Split(item.Value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	added := false
+	for _, user := range users {
+		line := user + ":" + publicKey
+		if !slices.Contains(lines, line) {
+			lines = append(lines, line)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+
+	keysFile, err := os.CreateTemp("", "raleigh-ssh-keys")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	defer os.Remove(keysFile.Name())
+	_, err = keysFile.WriteString(strings.Join(lines, "\n") + "\n")
+	keysFile.Close()
+	if err != nil {
+		return fmt.Errorf("error writing temp file: %w", err)
+	}
+	cmd = exec.CommandContext(ctx, "gcloud", "compute", "project-info", "add-metadata", "--project", cfg.project, "--metadata-from-file", "ssh-keys="+keysFile.Name())
+	stderr.Reset()
+	cmd.Stderr = &stderr
+	err = runCmd(ctx, "gcloud", "", cmd)
+	if err != nil {
+		return classify("adding ssh key to project metadata", "gcloud", err, stderr.String())
+	}
+	logger.Info("added ssh key to project metadata", "project", cfg.project, "users", users)
+	return nil
+}
+
+type osLoginProfile struct {
+	PosixAccounts []struct {
+		Primary  bool   `json:"primary"`
+		Username string `json:"username"`
+	} `json:"posixAccounts"`
+	SshPublicKeys map[string]struct {
+		Key string `json:"key"`
+	} `json:"sshPublicKeys"`
+}
+
+// registerOsLoginKey adds the key to the active account's OS Login profile and returns its POSIX user.
+func (a *sshAccess) registerOsLoginKey(ctx context.Context, cfg TpuConfig, publicKey string) (string, error) {
+	ctx, cancel := withTimeout(ctx, cfg.commandTimeout)
+	defer cancel()
+	profile, err := describeOsLoginProfile(ctx)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, key := range profile.SshPublicKeys {
+		found = found || strings.TrimSpace(key.Key) == publicKey
+	}
+	if !found {
+		cmd := exec.CommandContext(ctx, "gcloud", "compute", "os-login", "ssh-keys", "add", "--key-file", a.keyPath+".pub")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err = runCmd(ctx, "gcloud", "", cmd)
+		if err != nil {
+			return "", classify("adding ssh key to OS Login", "gcloud", err, stderr.String())
+		}
+		logger.Info("added ssh key to OS Login")
+		// the first key creates the POSIX account
+		profile, err = describeOsLoginProfile(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, account := range profile.PosixAccounts {
+		if account.Primary {
+			return account.Username, nil
+		}
+	}
+	if len(profile.PosixAccounts) > 0 {
+		return profile.PosixAccounts[0].Username, nil
+	}
+	return "", fmt.Errorf("the OS Login profile has no POSIX account")
+}
+
+func describeOsLoginProfile(ctx context.Context) (osLoginProfile, error) {
+	var profile osLoginProfile
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "os-login", "describe-profile", "--format", "json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := outputCmd(ctx, "gcloud", "", cmd)
+	if err != nil {
+		return profile, classify("reading OS Login profile", "gcloud", err, stderr.String())
+	}
+	err = json.Unmarshal(output, &profile)
+	if err != nil {
+		return profile, fmt.Errorf("error unmarshalling OS Login profile: %w", err)
+	}
+	return profile, nil
+}
+
+// options make ssh and scp use the launcher's key and trust nothing but the TPU's own host keys.
+func (a *sshAccess) options(alias string) []string {
+	return []string{
+		"-i", a.keyPath,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + a.knownHosts,
+		"-o", "GlobalKnownHostsFile=/dev/null",
+		"-o", "HostKeyAlias=" + alias,
+	}
+}
+
+// login is who to log in as to act as user, and the command to run there. OS Login has one
+// user per account, root is reached through sudo.
+func (a *sshAccess) login(user string, command string) (string, string) {
+	if a.osLoginUser == "" {
+		return user, command
+	}
+	if user == "root" && command != "" {
+		command = "sudo -n sh -c " + shellQuote(command)
+	}
+	return a.osLoginUser, command
+}
+
+func (a *sshAccess) address(alias string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.addresses[alias]
+}
+
+func (a *sshAccess) setAddress(alias string, ip string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.addresses[alias] = ip
+}
+
+// hasHostKeys reports whether known_hosts holds the keys of the TPU created at created.
+// The creation time is kept as the comment of its lines.
+func (a *sshAccess) hasHostKeys(alias string, created time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if stored, ok := a.hostKeys[alias]; ok {
+		return stored.Equal(created)
+	}
+	data, err := os.ReadFile(a.knownHosts)
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != alias {
+			continue
+		}
+		stored, err := time.Parse(time.RFC3339Nano, fields[3])
+		if err == nil {
+			a.hostKeys[alias] = stored
+			return stored.Equal(created)
+		}
+	}
+	return false
+}
+
+type hostKey struct {
+	keyType string
+	key     string
+}
+
+// storeHostKeys replaces the alias's lines in known_hosts.
+func (a *sshAccess) storeHostKeys(alias string, created time.Time, keys []hostKey) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	data, err := os.ReadFile(a.knownHosts)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading %s: %w", a.knownHosts, err)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == alias {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for _, key := range keys {
+		lines = append(lines, strings.Join([]string{alias, key.keyType, key.key, created.Format(time.RFC3339Nano)}, " "))
+	}
+	// written next to it and renamed, so ssh never reads half a file
+	temp, err := os.CreateTemp(a.dir, "known_hosts")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %w", err)
+	}
+	_, err = temp.WriteString(strings.Join(lines, "\n") + "\n")
+	temp.Close()
+	if err == nil {
+		err = os.Rename(temp.Name(), a.knownHosts)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("error writing %s: %w", a.knownHosts, err)
+	}
+	a.hostKeys[alias] = created
+	return nil
+}
+
+// hostKeyAlias names the TPU in known_hosts. Names repeat across projects and zones.
+func (t *TpuController) hostKeyAlias() string {
+	return t.id + "." + t.zone + "." + t.project
+}
+
+// address is where to reach the TPU, it is described first if nobody has yet.
+func (t *TpuController) address(ctx context.Context) string {
+	if ip := remoteAccess.address(t.hostKeyAlias()); ip != "" {
+		return ip
+	}
+	if t.latestInfo.IP == "" {
+		t.checkStatus(ctx)
+	}
+	return t.latestInfo.IP
+}
+
+// a booting TPU gets this long to publish its host keys before it counts as never publishing them
+const hostKeyGrace = 10 * time.Minute
+
+// refreshHostKeys keeps known_hosts in line with the TPU that runs under this name now. A TPU
+// publishes its host keys once its guest agent is up; until then hostKeyErr says why nothing
+// connects to it. A TPU created without guest attributes never publishes them.
+func (t *TpuController) refreshHostKeys(ctx context.Context) {
+	alias := t.hostKeyAlias()
+	if t.latestInfo.IP != "" {
+		remoteAccess.setAddress(alias, t.latestInfo.IP)
+	}
+	t.hostKeyErr = nil
+	if replay != nil || t.latestInfo.Status != tpuStatusRunning || remoteAccess.hasHostKeys(alias, t.latestInfo.CreateTime) {
+		return
+	}
+	keys, err := t.fetchHostKeys(ctx)
+	if err != nil {
+		t.hostKeyErr = fmt.Errorf("error fetching host keys: %w", err)
+		return
+	}
+	if len(keys) > 0 {
+		err = remoteAccess.storeHostKeys(alias, t.latestInfo.CreateTime, keys)
+		if err != nil {
+			t.hostKeyErr = err
+			return
+		}
+		logger.Info("stored host keys", "tpu", t.id, "keys", len(keys))
+		return
+	}
+	up := time.Since(t.latestInfo.CreateTime)
+	if up < hostKeyGrace {
+		t.hostKeyErr = kindError("waiting for the TPU to publish its host keys", failureSshUnreachable)
+		return
+	}
+	if !t.guestAttributesEnabled.Equal(t.latestInfo.CreateTime) {
+		// older TPUs were created without guest attributes, the guest agent may still pick them up
+		t.guestAttributesEnabled = t.latestInfo.CreateTime
+		err = t.enableGuestAttributes(ctx)
+		if err != nil {
+			logger.Warn("error enabling guest attributes", "tpu", t.id, "err", err)
+		} else {
+			logger.Info("enabled guest attributes", "tpu", t.id)
+		}
+	}
+	t.hostKeyErr = kindError(fmt.Sprintf("%s published no host keys in %s", t.id, up.Round(time.Minute)), failureHostKey)
+}
+
+func (t *TpuController) enableGuestAttributes(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "tpus", "tpu-vm", "update", t.id, "--project", t.project, "--zone", t.zone, "--update-metadata", "enable-guest-attributes=TRUE")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := runCmd(ctx, "gcloud", t.id, cmd)
+	return classify("enabling guest attributes", "gcloud", err, stderr.String())
+}
+
+// guestAttribute comes flattened or grouped under queryValue, depending on the gcloud version.
+type guestAttribute struct {
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	QueryValue struct {
+		Items []struct {
+			Namespace string `json:"namespace"`
+			Key       string `json:"key"`
+			Value     string `json:"value"`
+		} `json:"items"`
+	} `json:"queryValue"`
+}
+
+func (t *TpuController) fetchHostKeys(ctx context.Context) ([]hostKey, error) {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "tpus", "tpu-vm", "get-guest-attributes", t.id, "--project", t.project, "--zone", t.zone, "--worker", "0", "--query-path", "hostkeys/", "--format", "json")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := outputCmd(ctx, "gcloud", t.id, cmd)
+	if err != nil {
+		if failureOf(classify("", "gcloud", err, stderr.String())) == failureNotFound {
+			// nothing published under hostkeys/ yet
+			return nil, nil
+		}
+		return nil, classify("getting guest attributes", "gcloud", err, stderr.String())
+	}
+	var attributes []guestAttribute
+	err = json.Unmarshal(output, &attributes)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling guest attributes: %w", err)
+	}
+	keys := []hostKey{}
+	add := func(keyType, key string) {
+		// the guest agent publishes one attribute per key type, like ssh-ed25519 or ecdsa-sha2-nistp256
+		if (strings.HasPrefix(keyType, "ssh-") || strings.HasPrefix(keyType, "ecdsa-")) && key != "" && !strings.ContainsAny(key, " \n") {
+			keys = append(keys, hostKey{keyType: keyType, key: key})
+		}
+	}
+	for _, attribute := range attributes {
+		add(attribute.Key, attribute.Value)
+		for _, item := range attribute.QueryValue.Items {
+			if item.Namespace == "" || item.Namespace == "hostkeys" {
+				add(item.Key, item.Value)
+			}
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/table"
+	"github.com/charmbracelet/lipgloss"
+)
+
+type nodeSnapshot struct {
+	status TpuStatusUpdate
+	events []event
+}
+
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	age := time.Since(t)
+	switch {
+	case age < time.Minute:
+		return age.Round(time.Second).String()
+	case age < time.Hour:
+		return age.Round(time.Minute).String()
+	}
+	return age.Round(time.Hour).String()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "y"
+	}
+	return "n"
+}
+
+func shortHash(hash string) string {
+	hash, _ = strings.CutPrefix(hash, "h1:")
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	if hash == "" {
+		return "-"
+	}
+	return hash
+}
+
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) > n {
+		return s[:n-1] + "…"
+	}
+	return s
+}
+
+func newStatusTable() table.Model {
+	columns := []table.Column{
+		{Title: "Name", Width: 16},
+		{Title: "Zone", Width: 15},
+		{Title: "State", Width: 11},
+		{Title: "Health", Width: 9},
+		{Title: "External IP", Width: 15},
+		{Title: "Internal IP", Width: 15},
+		{Title: "I/C/R", Width: 5},
+		{Title: "PID", Width: 7},
+		{Title: "Repo", Width: 8},
+		{Title: "Group", Width: 7},
+		{Title: "Last error", Width: 40},
+		{Title: "Uptime", Width: 7},
+		{Title: "Action", Width: 30},
+	}
+	t := table.New(table.WithColumns(columns), table.WithFocused(true))
+	styles := table.DefaultStyles()
+	styles.Header = styles.Header.BorderStyle(lipgloss.NormalBorder()).BorderBottom(true).Bold(true)
+	styles.Selected = styles.Selected.Foreground(lipgloss.Color("229")).Background(lipgloss.Color("57"))
+	t.SetStyles(styles)
+	return t
+}
+
+func statusRows(nodes []nodeSnapshot, cfg TpuConfig) []table.Row {
+	rows := make([]table.Row, len(nodes))
+	for i, node := range nodes {
+		status := node.status
+		zone := status.info.Zone
+		if zone == "" {
+			zone = cfg.zone
+		}
+		pid := "-"
+		if status.pid > 0 {
+			pid = fmt.Sprint(status.pid)
+		}
+		group := "-"
+		if status.raleigh.IsReal() {
+			group = fmt.Sprint(status.raleigh.GroupId)
+		}
+		lastErr := "-"
+		if status.lastErr != nil {
+			lastErr = fmt.Sprintf("%s ago: %s", formatAge(status.lastErrAt), truncate(status.lastErr.Error(), 60))
+			if kind := failureOf(status.lastErr); kind != failureUnknown {
+				lastErr = fmt.Sprintf("%s ago: [%s] %s", formatAge(status.lastErrAt), kind, truncate(status.lastErr.Error(), 45))
+			}
+		}
+		uptime := "-"
+		if status.status == tpuStatusRunning {
+			uptime = formatAge(status.info.CreateTime)
+		}
+		action := status.action
+		if status.cordoned {
+			action = "[cordoned] " + action
+		}
+		rows[i] = table.Row{
+			tpuName(cfg, i),
+			zone,
+			status.status.String(),
+			status.info.Health,
+			status.info.IP,
+			status.info.InternalIP,
+			yesNo(status.installed) + "/" + yesNo(status.cloned) + "/" + yesNo(status.running),
+			pid,
+			shortHash(status.repoHash),
+			group,
+			lastErr,
+			uptime,
+			truncate(action, 30),
+		}
+	}
+	return rows
+}
+
+func renderNodeDetail(id int, node nodeSnapshot, cfg TpuConfig) string {
+	builder := strings.Builder{}
+	status := node.status
+	builder.WriteString(titleStyle.Render(tpuName(cfg, id)))
+	builder.WriteString("\n\n")
+
+	info := status.info
+	builder.WriteString("TPU\n")
+	for _, field := range [][2]string{
+		{"Status", info.Status.String()},
+		{"Health", info.Health},
+		{"External IP", info.IP},
+		{"Internal IP", fmt.Sprintf("%s:%d", info.InternalIP, info.InternalPort)},
+		{"Zone", info.Zone},
+		{"Project", info.Project},
+		{"Accelerator", info.AcceleratorType},
+		{"Version", info.Version},
+		{"Preemptible", fmt.Sprint(info.Preemptible)},
+		{"Spot", fmt.Sprint(info.Spot)},
+		{"Created", formatAge(info.CreateTime) + " ago"},
+	} {
+		builder.WriteString(fmt.Sprintf("  %-12s %s\n", field[0], field[1]))
+	}
+
+	builder.WriteString("\nProcess\n")
+	builder.WriteString(fmt.Sprintf("  %-12s %v / %v / %v\n", "I/C/R", status.installed, status.cloned, status.running))
+	builder.WriteString(fmt.Sprintf("  %-12s %d\n", "PID", status.pid))
+	builder.WriteString(fmt.Sprintf("  %-12s %s\n", "Repo hash", status.repoHash))
+	if len(status.probes) > 0 {
+		builder.WriteString(fmt.Sprintf("  %-12s %s\n", "Probes", probesView(status.probes)))
+	}
+	if status.lastErr != nil {
+		builder.WriteString(fmt.Sprintf("  %-12s %s ago: %s\n", "Last error", formatAge(status.lastErrAt), status.lastErr))
+		if kind := failureOf(status.lastErr); kind != failureUnknown {
+			builder.WriteString(fmt.Sprintf("  %-12s %s\n", "Kind", kind))
+			if hint := kind.Hint(); hint != "" {
+				builder.WriteString(fmt.Sprintf("  %-12s %s\n", "Hint", hint))
+			}
+		}
+	}
+	if status.exited != nil {
+		builder.WriteString(fmt.Sprintf("  %-12s %s ago: %s\n", "Last exit", formatAge(time.Unix(status.exited.EndTime, 0)), status.exited.Describe()))
+	}
+	builder.WriteString(fmt.Sprintf("  %-12s %v\n", "Cordoned", status.cordoned))
+	if status.action != "" {
+		builder.WriteString(fmt.Sprintf("  %-12s %s\n", "Action", status.action))
+	}
+
+	builder.WriteString("\nraleighInfo\n")
+	raleighJson, err := json.MarshalIndent(status.raleigh, "  ", "  ")
+	if err != nil {
+		builder.WriteString(fmt.Sprintf("  error marshalling: %v\n", err))
+	} else {
+		builder.WriteString("  " + string(raleighJson) + "\n")
+	}
+
+	builder.WriteString("\nRecent events\n")
+	if len(node.events) == 0 {
+		builder.WriteString("  none\n")
+	}
+	for _, e := range tail(node.events, 20) {
+		builder.WriteString("  " + formatEvent(e, cfg) + "\n")
+	}
+	return builder.String()
+}
+
+var actionKeys = map[string]nodeAction{
+	"r": actionRestart,
+	"i": actionReinstall,
+	"c": actionReclone,
+	"R": actionRecreate,
+	"D": actionDelete,
+	"x": actionCordon,
+	"u": actionUncordon,
+}
+
+const actionHelp = "r restart • i reinstall • c re-clone • R recreate • D delete • x cordon • u uncordon"
+
+type pendingConfirm struct {
+	id     int
+	action nodeAction
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type stopStage int
+
+const (
+	stopStageNone stopStage = iota
+	stopStageSignal
+	stopStageTerm
+	stopStageKill
+	stopStageStopped
+)
+
+func (s stopStage) describe(signal string) string {
+	switch s {
+	case stopStageSignal:
+		return fmt.Sprintf("sent SIG%s, waiting", signal)
+	case stopStageTerm:
+		return "sent SIGTERM, waiting"
+	case stopStageKill:
+		return "sent SIGKILL"
+	case stopStageStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// normalizeSignal turns "sigusr1", "SIGUSR1" and "USR1" into the form `kill -s` expects.
+func normalizeSignal(signal string) string {
+	signal = strings.ToUpper(strings.TrimSpace(signal))
+	signal, _ = strings.CutPrefix(signal, "SIG")
+	if signal == "" {
+		return "TERM"
+	}
+	return signal
+}
+
+// stopTargets is the run wrapper, which forwards signals to everything it launched.
+// Without one, we go after whatever is holding the TPU.
+func (t *TpuInstaller) stopTargets(ctx context.Context) []int {
+	if t.runningPid != -1 {
+		return []int{t.runningPid}
+	}
+	return t.GetTpuLockfileUser(ctx)
+}
+
+func (t *TpuInstaller) signalAll(ctx context.Context, pids []int, signal string) ([]int, error) {
+	alive := []int{}
+	for _, pid := range pids {
+		existed, err := t.tpuController.signalProcess(ctx, pid, signal)
+		if err != nil {
+			return nil, err
+		}
+		if existed {
+			alive = append(alive, pid)
+		}
+	}
+	return alive, nil
+}
+
+func (t *TpuInstaller) waitAll(ctx context.Context, pids []int, timeout time.Duration) ([]int, error) {
+	wait, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	alive := []int{}
+	for _, pid := range pids {
+		exited, err := t.tpuController.waitProcessExit(wait, pid, 1*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			// cancelled rather than timed out, the processes are left as they are
+			return nil, ctx.Err()
+		}
+		if !exited {
+			alive = append(alive, pid)
+		}
+	}
+	return alive, nil
+}
+
+// SendStopSignal delivers the configured stop signal (e.g. SIGUSR1 to ask for a checkpoint)
+// without waiting for anything. It is the first half of a group-wide stop.
+func (t *TpuInstaller) SendStopSignal(ctx context.Context, report func(stopStage)) error {
+	pids := t.stopTargets(ctx)
+	if len(pids) == 0 {
+		return nil
+	}
+	_, err := t.signalAll(ctx, pids, t.cfg.stopSignal)
+	if err != nil {
+		return fmt.Errorf("error sending stop signal: %w", err)
+	}
+	report(stopStageSignal)
+	return nil
+}
+
+// StopRunningProcess waits out the grace period after the stop signal, then escalates to
+// SIGTERM and finally SIGKILL. If signalSent is false the stop signal is sent first.
+func (t *TpuInstaller) StopRunningProcess(ctx context.Context, signalSent bool, report func(stopStage)) error {
+	if !signalSent {
+		err := t.SendStopSignal(ctx, report)
+		if err != nil {
+			return err
+		}
+	}
+	err := t.escalate(ctx, t.stopTargets(ctx), t.cfg.stopGracePeriod, t.cfg.stopSignal != "TERM", report)
+	if err != nil {
+		return err
+	}
+	// a SIGKILLed wrapper can't pass the signal on, so its children may still hold the TPU
+	leftovers := t.GetTpuLockfileUser(ctx)
+	if len(leftovers) > 0 {
+		_, err = t.signalAll(ctx, leftovers, "TERM")
+		if err != nil {
+			return fmt.Errorf("error terminating tpu lockfile user: %w", err)
+		}
+		err = t.escalate(ctx, leftovers, t.cfg.stopTimeout, false, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = runCommand(ctx, t, "rm -f /tmp/libtpu_lockfile ~/.raleigh/running.pid")
+	if err != nil {
+		return fmt.Errorf("error removing pid file: %s", err)
+	}
+	t.runningPid = -1
+	report(stopStageStopped)
+	return nil
+}
+
+// escalate waits for pids to exit after a signal, then sends SIGTERM (if term is set) and SIGKILL.
+func (t *TpuInstaller) escalate(ctx context.Context, pids []int, wait time.Duration, term bool, report func(stopStage)) error {
+	alive, err := t.waitAll(ctx, pids, wait)
+	if err != nil {
+		return fmt.Errorf("error waiting for process to stop: %w", err)
+	}
+	if len(alive) > 0 && term {
+		alive, err = t.signalAll(ctx, alive, "TERM")
+		if err != nil {
+			return fmt.Errorf("error terminating process: %w", err)
+		}
+		report(stopStageTerm)
+		alive, err = t.waitAll(ctx, alive, t.cfg.stopTimeout)
+		if err != nil {
+			return fmt.Errorf("error waiting for process to terminate: %w", err)
+		}
+	}
+	if len(alive) > 0 {
+		// tells the wrapper this SIGKILL is ours, so the exit isn't taken for an OOM kill
+		err = runCommand(ctx, t, "touch "+stopKilledPath)
+		if err != nil {
+			logger.Warn("error marking stop escalation", "tpu", t.tpuController.id, "err", err)
+		}
+		alive, err = t.signalAll(ctx, alive, "KILL")
+		if err != nil {
+			return fmt.Errorf("error killing process: %w", err)
+		}
+		report(stopStageKill)
+		alive, err = t.waitAll(ctx, alive, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("error waiting for process to die: %w", err)
+		}
+		if len(alive) > 0 {
+			return fmt.Errorf("processes %v survived SIGKILL", alive)
+		}
+	}
+	return nil
+}
@@ -2,14 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os/exec"
 	"strings"
 	"time"
-
-	"golang.org/x/net/context"
 )
 
 type TpuController struct {
@@ -21,6 +19,30 @@ type TpuController struct {
 	spot         bool
 	latestInfo   tpuInfo
 	latestStatus tpuStatus
+	// latestErr is why latestStatus is tpuStatusError
+	latestErr        error
+	commandTimeout   time.Duration
+	provisionTimeout time.Duration
+	installTimeout   time.Duration
+	// hostKeyErr is why nothing can connect to the TPU yet, nil once its host keys are known
+	hostKeyErr error
+	// the creation time of the TPU guest attributes were last turned on for
+	guestAttributesEnabled time.Time
+}
+
+func NewTpuController(cfg TpuConfig, id string) *TpuController {
+	return &TpuController{
+		project:      cfg.project,
+		zone:         cfg.zone,
+		instanceType: cfg.instanceType,
+		id:           id,
+		spot:         cfg.spot,
+		preemptible:  cfg.preemptible,
+
+		commandTimeout:   cfg.commandTimeout,
+		provisionTimeout: cfg.provisionTimeout,
+		installTimeout:   cfg.installTimeout,
+	}
 }
 
 type tpuStatus int
@@ -32,9 +54,30 @@ const (
 	tpuStatusStopping
 	tpuStatusStopped
 	tpuStatusDeleting
+	tpuStatusPreempted
 	tpuStatusError
 )
 
+func (s tpuStatus) String() string {
+	switch s {
+	case tpuStatusNonexistent:
+		return "NONEXISTENT"
+	case tpuStatusCreating:
+		return "CREATING"
+	case tpuStatusRunning:
+		return "READY"
+	case tpuStatusStopping:
+		return "STOPPING"
+	case tpuStatusStopped:
+		return "STOPPED"
+	case tpuStatusDeleting:
+		return "DELETING"
+	case tpuStatusPreempted:
+		return "PREEMPTED"
+	}
+	return "ERROR"
+}
+
 func tpuStatusFromString(s string) tpuStatus {
 	switch s {
 	case "CREATING":
@@ -45,6 +88,10 @@ func tpuStatusFromString(s string) tpuStatus {
 		return tpuStatusStopping
 	case "STOPPED":
 		return tpuStatusStopped
+	case "DELETING":
+		return tpuStatusDeleting
+	case "PREEMPTED":
+		return tpuStatusPreempted
 	}
 	return tpuStatusError
 }
@@ -65,6 +112,7 @@ type tpuInfo struct {
 	Preemptible     bool
 	Spot            bool
 	Health          string
+	CreateTime      time.Time
 }
 
 type tpuInfoRaw struct {
@@ -83,34 +131,40 @@ type tpuInfoRaw struct {
 	SchedulingConfig struct {
 		Preemptible bool `json:"preemptible"`
 	} `json:"schedulingConfig"`
-	Health string `json:"health"`
+	Health     string    `json:"health"`
+	CreateTime time.Time `json:"createTime"`
 }
 
-func (t *TpuController) checkStatus() (tpuInfo, tpuStatus) {
-	cmd := exec.Command("gcloud", "compute", "tpus", "tpu-vm", "describe", t.id, "--project", t.project, "--zone", t.zone, "--format", "json")
+func (t *TpuController) checkStatus(ctx context.Context) (tpuInfo, tpuStatus) {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "tpus", "tpu-vm", "describe", t.id, "--project", t.project, "--zone", t.zone, "--format", "json")
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	tpuJson, err := cmd.Output()
+	tpuJson, err := outputCmd(ctx, "describe", t.id, cmd)
+	t.latestErr = classify("describing tpu", "describe", err, stderr.String())
 	if err != nil {
-		if strings.HasPrefix(stderr.String(), "ERROR: (gcloud.compute.tpus.tpu-vm.describe) NOT_FOUND: ") {
+		if failureOf(t.latestErr) == failureNotFound {
 			t.latestStatus = tpuStatusNonexistent
 			return t.latestInfo, t.latestStatus
 		}
-		log.Printf("fatal error getting tpu: %v\n", stderr.String())
+		logger.Error("error describing tpu", "tpu", t.id, "kind", failureOf(t.latestErr), "err", t.latestErr)
 		t.latestStatus = tpuStatusError
 		return t.latestInfo, t.latestStatus
 	}
 	var tpu gCloudTPU
 	err = json.Unmarshal(tpuJson, &tpu)
 	if err != nil {
-		log.Printf("fatal error unmarshalling tpu: %v\n", err)
+		t.latestErr = fmt.Errorf("error unmarshalling tpu: %w", err)
+		logger.Error("error unmarshalling tpu", "tpu", t.id, "err", err)
 		t.latestStatus = tpuStatusError
 		return t.latestInfo, t.latestStatus
 	}
 	var tpuInformation tpuInfoRaw
 	err = json.Unmarshal(tpuJson, &tpuInformation)
 	if err != nil {
-		log.Printf("fatal error unmarshalling tpu: %v\n", err)
+		t.latestErr = fmt.Errorf("error unmarshalling tpu: %w", err)
+		logger.Error("error unmarshalling tpu", "tpu", t.id, "err", err)
 		return tpuInfo{}, tpuStatusError
 	}
 	t.latestInfo = tpuInfo{
@@ -124,123 +178,170 @@ func (t *TpuController) checkStatus() (tpuInfo, tpuStatus) {
 		Version:         tpuInformation.Version,
 		Preemptible:     tpuInformation.SchedulingConfig.Preemptible,
 		Health:          tpuInformation.Health,
+		CreateTime:      tpuInformation.CreateTime,
 	}
 	t.latestStatus = t.latestInfo.Status
+	t.refreshHostKeys(ctx)
 	return t.latestInfo, t.latestStatus
 }
 
-func (t *TpuController) scp(localPath string, remotePath string, user string) error {
-	cmd := exec.Command("gcloud", "compute", "tpus", "tpu-vm", "scp", "--recurse", localPath, user+"@"+t.id+":"+remotePath, "--project", t.project, "--zone", t.zone)
+func (t *TpuController) scp(ctx context.Context, localPath string, remotePath string, user string) error {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := t.scpCmd(ctx, []string{"-r"}, localPath, t.remotePath(ctx, user, remotePath))
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error scp: %v", stderr.String())
-	}
-	return nil
+	err := runCmd(ctx, "scp", t.id, cmd)
+	return classify("scp", "scp", err, stderr.String())
 }
 
-func (t *TpuController) rsync(localPath string, remotePath string, user string) error {
+func (t *TpuController) rsync(ctx context.Context, localPath string, remotePath string, user string) error {
 	if t.latestInfo.Status != tpuStatusRunning {
 		return fmt.Errorf("tpu must be running to rsync")
 	}
-	cmd := exec.Command("rsync", "-avz", localPath+"/", user+"@"+t.latestInfo.IP+":"+remotePath, "-e", "ssh -i ~/.ssh/google_compute_engine -o \"StrictHostKeyChecking=no\"")
+	// a big repo takes a while, so it gets the install timeout
+	ctx, cancel := withTimeout(ctx, t.installTimeout)
+	defer cancel()
+	remoteShell := []string{"ssh"}
+	for _, option := range remoteAccess.options(t.hostKeyAlias()) {
+		remoteShell = append(remoteShell, shellQuote(option))
+	}
+	cmd := exec.CommandContext(ctx, "rsync", "-avz", "-e", strings.Join(remoteShell, " "), localPath+"/", t.remotePath(ctx, user, remotePath))
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error rsync: %v", stderr.String())
-	}
-	return nil
+	err := runCmd(ctx, "rsync", t.id, cmd)
+	return classify("rsync", "rsync", err, stderr.String())
 }
 
-func (t *TpuController) checkProcessRunning(pid int) (bool, error) {
+func (t *TpuController) checkProcessRunning(ctx context.Context, pid int) (bool, error) {
 	if pid == -1 {
 		return false, nil
 	}
-	cmd := t.ssh("root", fmt.Sprintf("kill -0 %d", pid))
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := t.ssh(ctx, "root", fmt.Sprintf("kill -0 %d", pid))
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		if strings.Contains(stderr.String(), "No such process") {
-			return false, nil
-		}
-		return false, fmt.Errorf("error checking process running: %v", stderr.String())
-	}
-	return true, nil
+	err := classify("checking process running", "ssh", runCmd(ctx, "ssh", t.id, cmd), stderr.String())
+	return killResult(err, stderr.String())
 }
 
-func (t *TpuController) killProcess(pid int, retry time.Duration, ctx context.Context) error {
+func (t *TpuController) signalProcess(ctx context.Context, pid int, signal string) (bool, error) {
 	if pid == -1 {
-		return nil
+		return false, nil
 	}
-	cmd := t.ssh("root", fmt.Sprintf("kill %d", pid))
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := t.ssh(ctx, "root", fmt.Sprintf("kill -s %s %d", signal, pid))
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		if strings.Contains(stderr.String(), "No such process") {
-			return nil
-		}
-		return fmt.Errorf("error killing process: %v", stderr.String())
+	err := classify(fmt.Sprintf("sending SIG%s to process", signal), "ssh", runCmd(ctx, "ssh", t.id, cmd), stderr.String())
+	return killResult(err, stderr.String())
+}
+
+// killResult is whether kill found the process. Only kill's own "No such process" means it's
+// gone; under OS Login root commands go through sudo, which fails without passwordless sudo.
+func killResult(err error, stderr string) (bool, error) {
+	if err == nil {
+		return true, nil
 	}
+	if failureOf(err) != failureRemoteCommand {
+		return false, err
+	}
+	if strings.Contains(stderr, "No such process") {
+		return false, nil
+	}
+	if strings.Contains(stderr, "sudo:") {
+		return false, &cloudError{kind: failurePermissionDenied, message: fmt.Sprintf("%s (%s has no passwordless sudo)", err, remoteAccess.osLoginUser), err: err}
+	}
+	return false, err
+}
 
+// waitProcessExit polls until the process is gone, or returns false when ctx is done first.
+func (t *TpuController) waitProcessExit(ctx context.Context, pid int, retry time.Duration) (bool, error) {
 	ticker := time.NewTicker(retry)
 	defer ticker.Stop()
 
 	for {
+		running, err := t.checkProcessRunning(ctx, pid)
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !running {
+			return true, nil
+		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return false, nil
 		case <-ticker.C:
-			checkCmd := t.ssh("root", fmt.Sprintf("kill %d", pid))
-			var checkErr bytes.Buffer
-			checkCmd.Stderr = &checkErr
-			err := checkCmd.Run()
-			if err != nil {
-				if strings.Contains(checkErr.String(), "No such process") {
-					return nil
-				}
-				return fmt.Errorf("error killing process: %v", checkErr.String())
-			}
 		}
 	}
 }
 
-func (t *TpuController) scpFrom(user string, localPath string, remotePath string) error {
-	cmd := exec.Command("gcloud", "compute", "tpus", "tpu-vm", "scp", user+"@"+t.id+":"+remotePath, localPath, "--project", t.project, "--zone", t.zone)
+func (t *TpuController) scpFrom(ctx context.Context, user string, localPath string, remotePath string) error {
+	ctx, cancel := withTimeout(ctx, t.commandTimeout)
+	defer cancel()
+	cmd := t.scpCmd(ctx, nil, t.remotePath(ctx, user, remotePath), localPath)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error scp from: %v", stderr.String())
-	}
-	return nil
+	err := runCmd(ctx, "scp", t.id, cmd)
+	return classify("scp from", "scp", err, stderr.String())
+}
+
+// ssh builds the command only, the caller picks the timeout for it.
+func (t *TpuController) ssh(ctx context.Context, user string, command string) *exec.Cmd {
+	login, command := remoteAccess.login(user, command)
+	args := append(remoteAccess.options(t.hostKeyAlias()), "--", login+"@"+t.address(ctx), command)
+	return exec.CommandContext(ctx, "ssh", args...)
 }
 
-func (t *TpuController) ssh(user string, command string) *exec.Cmd {
-	return exec.Command("gcloud", "compute", "tpus", "tpu-vm", "ssh", user+"@"+t.id, "--project", t.project, "--zone", t.zone, "--command", command)
+// interactiveSsh opens a login shell on the TPU, for handing the terminal over to the user.
+// ctx is only for looking the TPU up, the shell ends when the user leaves it.
+func (t *TpuController) interactiveSsh(ctx context.Context, user string) *exec.Cmd {
+	login, _ := remoteAccess.login(user, "")
+	args := append(remoteAccess.options(t.hostKeyAlias()), "--", login+"@"+t.address(ctx))
+	return exec.Command("ssh", args...)
 }
 
-func (t *TpuController) start() error {
-	args := []string{"compute", "tpus", "tpu-vm", "create", t.id, "--project", t.project, "--zone", t.zone, "--accelerator-type", t.instanceType, "--version", "tpu-ubuntu2204-base"}
+func (t *TpuController) scpCmd(ctx context.Context, flags []string, source string, target string) *exec.Cmd {
+	args := append(remoteAccess.options(t.hostKeyAlias()), flags...)
+	return exec.CommandContext(ctx, "scp", append(args, "--", source, target)...)
+}
+
+// remotePath is path on the TPU as scp and rsync take it.
+func (t *TpuController) remotePath(ctx context.Context, user string, path string) string {
+	login, _ := remoteAccess.login(user, "")
+	return login + "@" + t.address(ctx) + ":" + path
+}
+
+func (t *TpuController) start(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.provisionTimeout)
+	defer cancel()
+	args := []string{"compute", "tpus", "tpu-vm", "create", t.id, "--project", t.project, "--zone", t.zone, "--accelerator-type", t.instanceType, "--version", "tpu-ubuntu2204-base",
+		// the guest agent publishes the host keys there
+		"--metadata", "enable-guest-attributes=TRUE"}
 	if t.preemptible {
 		args = append(args, "--preemptible")
 	}
 	if t.spot {
 		args = append(args, "--spot")
 	}
-	cmd := exec.Command("gcloud", args...)
+	cmd := exec.CommandContext(ctx, "gcloud", args...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		return fmt.Errorf("error starting tpu: %v", stderr.String())
-	}
-	return nil
+	err := runCmd(ctx, "create", t.id, cmd)
+	return classify("starting tpu", "create", err, stderr.String())
 }
 
-func (t *TpuController) delete() error {
-	return exec.Command("gcloud", "compute", "tpus", "tpu-vm", "delete", t.id, "--project", t.project, "--zone", t.zone, "--quiet").Run()
+func (t *TpuController) delete(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, t.provisionTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "gcloud", "compute", "tpus", "tpu-vm", "delete", t.id, "--project", t.project, "--zone", t.zone, "--quiet")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := runCmd(ctx, "delete", t.id, cmd)
+	return classify("deleting tpu", "delete", err, stderr.String())
 }
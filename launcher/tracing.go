@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Spans travel in the context and go to a local file or to an OTLP/HTTP collector.
+// Tracing is off by default, and then the global tracer provider hands out no-op spans.
+
+const (
+	traceBatchSize     = 100
+	traceFlushInterval = 5 * time.Second
+	traceScope         = "github.com/neverix/raleigh/launcher"
+)
+
+var tracerProvider *sdktrace.TracerProvider
+
+// setupTracing reads tracing (off, file or otlp) from the config.
+// With file, spans go to ~/.raleigh/traces/<name>.jsonl, one JSON span per line.
+func setupTracing(name string) error {
+	var exporter sdktrace.SpanExporter
+	switch viper.GetString("tracing") {
+	case "", "off":
+		return nil
+	case "file":
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("error getting home directory: %w", err)
+		}
+		traceDir := filepath.Join(homeDir, ".raleigh", "traces")
+		err = os.MkdirAll(traceDir, 0755)
+		if err != nil {
+			return fmt.Errorf("error creating trace directory: %w", err)
+		}
+		file, err := os.OpenFile(filepath.Join(traceDir, name+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening trace file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			return fmt.Errorf("error creating trace exporter: %w", err)
+		}
+	case "otlp":
+		endpoint := strings.TrimSuffix(viper.GetString("otlpEndpoint"), "/") + "/v1/traces"
+		var err error
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			return fmt.Errorf("error creating trace exporter: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown tracing %q, expected off, file or otlp", viper.GetString("tracing"))
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithMaxExportBatchSize(traceBatchSize), sdktrace.WithBatchTimeout(traceFlushInterval)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "raleigh-"+name))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	return nil
+}
+
+// flushTraces writes out whatever is still pending, for right before exiting.
+func flushTraces() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := tracerProvider.ForceFlush(ctx)
+	if err != nil {
+		logger.Warn("error exporting spans", "err", err)
+	}
+}
+
+// startSpan starts a span under the one in ctx, or a new trace when ctx has none.
+// attrs are key-value pairs like with slog.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, trace.Span) {
+	return otel.Tracer(traceScope).Start(ctx, name, trace.WithAttributes(spanAttrs(attrs...)...))
+}
+
+// childSpan is startSpan, but leaves ctx untraced when it has no span, so leaf operations
+// only show up inside a phase.
+func childSpan(ctx context.Context, name string, attrs ...any) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, noop.Span{}
+	}
+	return startSpan(ctx, name, attrs...)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+}
+
+func spanAttrs(attrs ...any) []attribute.KeyValue {
+	result := []attribute.KeyValue{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key := fmt.Sprint(attrs[i])
+		switch v := attrs[i+1].(type) {
+		case int:
+			result = append(result, attribute.Int(key, v))
+		case int32:
+			result = append(result, attribute.Int(key, int(v)))
+		case float64:
+			result = append(result, attribute.Float64(key, v))
+		case bool:
+			result = append(result, attribute.Bool(key, v))
+		default:
+			result = append(result, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return result
+}
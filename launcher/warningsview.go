@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/viewport"
+)
+
+// warningsView shows what the launcher itself logged at warn and above.
+type warningsView struct {
+	viewport viewport.Model
+	seen     int
+}
+
+func newWarningsView() warningsView {
+	return warningsView{viewport: viewport.New(0, 0)}
+}
+
+func (v *warningsView) SetSize(width, height int) {
+	v.viewport.Width = width
+	v.viewport.Height = max(height-1, 0)
+}
+
+func (v *warningsView) refresh() {
+	recent, total := warnings.Recent()
+	lines := make([]string, len(recent))
+	for i, w := range recent {
+		style := skewWarnStyle
+		if w.level >= slog.LevelError {
+			style = execFailStyle
+		}
+		lines[i] = fmt.Sprintf("%s %s %s", w.at.Format("15:04:05"), style.Render(w.level.String()), strings.ReplaceAll(w.message, "\n", "\\n"))
+	}
+	atBottom := v.viewport.AtBottom()
+	v.viewport.SetContent(strings.Join(lines, "\n"))
+	if atBottom {
+		v.viewport.GotoBottom()
+	}
+	v.seen = total
+}
+
+// unseen counts the warnings logged since the pane was last open.
+func (v *warningsView) unseen() int {
+	_, total := warnings.Recent()
+	return total - v.seen
+}
+
+func (v *warningsView) View() string {
+	dir, _ := logDir()
+	return v.viewport.View() + "\n" + logHelpStyle.Render("↑/↓ scroll • full logs in "+dir+" • esc back")
+}
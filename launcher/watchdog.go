@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchdog decides whether a running group is making progress. A rank progresses when it
+// reports a new step or when its log grows.
+type watchdog struct {
+	mutex   sync.Mutex
+	cfg     TpuConfig
+	metrics *metricsStore
+	logs    *logHub
+	groupId int
+	since   time.Time
+	// the ranks running in the group, as of the last hang check
+	ranks []int
+}
+
+// metrics older than this don't say where a rank is now
+const metricsFreshFor = 5 * time.Minute
+
+func newWatchdog(cfg TpuConfig, metrics *metricsStore, logs *logHub) *watchdog {
+	return &watchdog{cfg: cfg, metrics: metrics, logs: logs}
+}
+
+type hangError struct {
+	idle time.Duration
+}
+
+func (e *hangError) Error() string {
+	return fmt.Sprintf("hung: no progress for %s", e.idle.Round(time.Second))
+}
+
+func (w *watchdog) lastProgress(ids []int) time.Time {
+	last := w.since
+	ranks := w.metrics.Snapshot()
+	for _, id := range ids {
+		if ranks[id].updated.After(last) {
+			last = ranks[id].updated
+		}
+		if lastLine := w.logs.LastLine(id); lastLine.After(last) {
+			last = lastLine
+		}
+	}
+	return last
+}
+
+// Hold restarts the clock while the group isn't ready yet; startup doesn't count as a hang.
+func (w *watchdog) Hold(groupId int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.groupId = groupId
+	w.since = time.Now()
+	w.ranks = nil
+}
+
+// CheckHang returns a *hangError if none of the given ranks of the group progressed for hangTimeout.
+func (w *watchdog) CheckHang(groupId int, ids []int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if groupId != w.groupId {
+		// a group is given the full timeout from when we first see it
+		w.groupId = groupId
+		w.since = time.Now()
+		w.ranks = ids
+		return nil
+	}
+	w.ranks = ids
+	if w.cfg.hangTimeout <= 0 || len(ids) == 0 {
+		return nil
+	}
+	idle := time.Since(w.lastProgress(ids))
+	if idle > w.cfg.hangTimeout {
+		return &hangError{idle: idle}
+	}
+	return nil
+}
+
+// Compared is the ranks whose steps can be compared: running in the current group and
+// reporting since it started. Ranks left over from an earlier run would skew the median.
+func (w *watchdog) Compared() []int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	ranks := w.metrics.Snapshot()
+	compared := []int{}
+	for _, id := range w.ranks {
+		updated := ranks[id].updated
+		if updated.After(w.since) && time.Since(updated) < metricsFreshFor {
+			compared = append(compared, id)
+		}
+	}
+	return compared
+}
+
+// Stragglers lists the compared ranks whose step lags their median by more than stragglerSteps.
+func (w *watchdog) Stragglers() []string {
+	if w.cfg.stragglerSteps <= 0 {
+		return nil
+	}
+	ranks := w.metrics.Snapshot()
+	compared := w.Compared()
+	median := medianStep(ranks, compared)
+	stragglers := []string{}
+	for _, i := range compared {
+		rank := ranks[i]
+		if lag := median - rank.latest.Step; lag > int64(w.cfg.stragglerSteps) {
+			stragglers = append(stragglers, fmt.Sprintf("%s (%d steps behind)", tpuName(w.cfg, i), lag))
+		}
+	}
+	return stragglers
+}
+
+// CollectDiagnostics saves py-spy dumps of the node's python processes and the tail of its log
+// into dir, so a hang can be looked at after the group has been restarted.
+func (t *TpuInstaller) CollectDiagnostics(ctx context.Context, dir string, logTail []logLine) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating diagnostics directory: %w", err)
+	}
+	// py-spy needs ptrace, so this runs as root with the user's uv
+	ctx, cancel := withTimeout(ctx, t.cfg.commandTimeout)
+	defer cancel()
+	cmd := t.tpuController.ssh(ctx, "root", fmt.Sprintf(
+		"for pid in $(pgrep -u %s python); do echo \"== py-spy dump $pid\"; /home/%s/.local/bin/uvx py-spy dump --pid $pid 2>&1; done",
+		t.cfg.username, t.cfg.username,
+	))
+	stdout := bytes.Buffer{}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stdout
+	dumpErr := runCmd(ctx, "ssh", t.tpuController.id, cmd)
+
+	builder := strings.Builder{}
+	builder.WriteString(stdout.String())
+	if dumpErr != nil {
+		builder.WriteString(fmt.Sprintf("== py-spy failed: %v\n", dumpErr))
+	}
+	builder.WriteString("== log tail\n")
+	for _, line := range logTail {
+		builder.WriteString(line.text)
+		builder.WriteString("\n")
+	}
+	err = os.WriteFile(filepath.Join(dir, t.tpuController.id+".txt"), []byte(builder.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing diagnostics: %w", err)
+	}
+	return nil
+}
+
+// a group is restarted after it hangs, so it only ever needs one diagnostics directory
+func hangDiagnosticsDir(groupId int) (string, error) {
+	runDir, err := localRunDir(groupId)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(runDir, "hang"), nil
+}
+
+func tail[T any](items []T, n int) []T {
+	return items[len(items)-min(n, len(items)):]
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand/v2"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TpuStatusUpdate struct {
@@ -15,7 +18,24 @@ type TpuStatusUpdate struct {
 	installed bool
 	cloned    bool
 	running   bool
+	stopStage stopStage
+	ready     bool
+	probes    []probeResult
+	pid       int
+	repoHash  string
+	raleigh   raleighInfo
+	exited    *exitStatus
 	err       error
+	lastErr   error
+	lastErrAt time.Time
+	cordoned  bool
+	busy      bool
+	action    string
+}
+
+// eligible is whether the node can be part of the active group.
+func (s TpuStatusUpdate) eligible() bool {
+	return s.status == tpuStatusRunning && s.installed && s.cloned && !s.cordoned && !s.busy
 }
 
 type TpuCurrentStatus struct {
@@ -24,17 +44,32 @@ type TpuCurrentStatus struct {
 }
 
 type TpuWatcher struct {
+	cfg           TpuConfig
 	tpuInstallers []*TpuInstaller
 	updates       chan TpuStatusUpdate
 	statuses      []TpuCurrentStatus
+	restarts      *restartTracker
+	logs          *logHub
+	metrics       *metricsStore
+	watchdog      *watchdog
+	probes        *probeRunner
+	controls      []*nodeControl
+	events        *eventLog
+	started       time.Time
+	// set when attached to a daemon instead of watching the TPUs from this process
+	remote *daemonMirror
 }
 
+// Synchronizer is the barrier the nodes of a group meet at. Once ctx is done every call gives
+// up with its error; the nodes share ctx, so they all leave and it isn't used again.
 type Synchronizer struct {
 	chans         []chan struct{}
 	anyChans      []chan any
 	alreadyLocked int
-	lock          sync.Mutex
-	cond          *sync.Cond
+	// generation counts the barriers that everyone got through
+	generation int
+	lock       sync.Mutex
+	cond       *sync.Cond
 }
 
 func (s *Synchronizer) Add(n int) {
@@ -47,44 +82,78 @@ func (s *Synchronizer) Add(n int) {
 	s.cond = sync.NewCond(&s.lock)
 }
 
-func (s *Synchronizer) Sync() int {
+func (s *Synchronizer) Sync(ctx context.Context) (int, error) {
 	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	myIndex := s.alreadyLocked
 	s.alreadyLocked++
 	if myIndex == len(s.chans)-1 {
 		s.alreadyLocked = 0
+		s.generation++
+		s.cond.Broadcast()
+		return myIndex, nil
+	}
+	generation := s.generation
+	// a Cond can't wait on ctx, so ctx wakes everyone up to look
+	stop := context.AfterFunc(ctx, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
 		s.cond.Broadcast()
-	} else {
+	})
+	defer stop()
+	for s.generation == generation {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
 		s.cond.Wait()
 	}
-	s.lock.Unlock()
-	return myIndex
+	return myIndex, nil
 }
 
-func (s *Synchronizer) AllGather(value any) []any {
-	myIndex := s.Sync()
+func (s *Synchronizer) AllGather(ctx context.Context, value any) ([]any, error) {
+	myIndex, err := s.Sync(ctx)
+	if err != nil {
+		return nil, err
+	}
 	results := make([]any, len(s.chans))
 	results[0] = value
 	for i := 0; i < len(s.chans); i++ {
 		if i == myIndex {
 			for j := range len(s.chans) - 1 {
-				results[j+1] = <-s.anyChans[i]
+				select {
+				case results[j+1] = <-s.anyChans[i]:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
 			}
 		} else {
-			s.anyChans[i] <- value
+			select {
+			case s.anyChans[i] <- value:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
 	}
-	return results
+	return results, nil
 }
 
-func (s *Synchronizer) SyncAll() (int, []int) {
-	myIndex := s.Sync()
-	results := s.AllGather(myIndex)
+func (s *Synchronizer) SyncAll(ctx context.Context) (int, []int, error) {
+	myIndex, err := s.Sync(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	results, err := s.AllGather(ctx, myIndex)
+	if err != nil {
+		return 0, nil, err
+	}
 	indices := make([]int, len(results))
 	for i, result := range results {
 		indices[i] = result.(int)
 	}
-	return myIndex, indices
+	return myIndex, indices, nil
 }
 
 type hostSync struct {
@@ -92,23 +161,96 @@ type hostSync struct {
 	index int
 }
 
+// waitGroup is wg.Wait that gives up when ctx is done. The goroutine waiting on wg is left
+// behind then, nodes that already left won't call Done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func posmod(a, b int) int {
 	return (a%b + b*2) % b
 }
 
-func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuStatusUpdate, statuses *[]TpuCurrentStatus, groupWg *sync.WaitGroup, activeSynchronizer *Synchronizer, currentGroupId *atomic.Int32) {
+func Watch(ctx context.Context, cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuStatusUpdate, statuses *[]TpuCurrentStatus, groupWg *sync.WaitGroup, activeSynchronizer *Synchronizer, currentGroupId *atomic.Int32, restarts *restartTracker, logs *logHub, metrics *metricsStore, watchdog *watchdog, probes *probeRunner, control *nodeControl, events *eventLog) {
+	tpu := tpuName(cfg, id)
+	nodeLog := logger.With("node", tpu, "rank", id)
+	// bringUp spans everything from the first step towards a group to the process starting,
+	// phases nest under it and commands under the phase they run in
+	// bringUpCtx and phaseCtx carry them, both are nil outside of a bring-up
+	var bringUp trace.Span
+	var bringUpCtx, phaseCtx context.Context
+	startBringUp := func() {
+		if bringUp == nil {
+			bringUpCtx, bringUp = startSpan(ctx, "bring_up", "node", tpu, "rank", id)
+		}
+	}
+	// current is the innermost traced context, plain ctx outside of a bring-up
+	current := func() context.Context {
+		switch {
+		case phaseCtx != nil:
+			return phaseCtx
+		case bringUpCtx != nil:
+			return bringUpCtx
+		}
+		return ctx
+	}
+	traced := func(name string, f func(ctx context.Context) error) error {
+		startBringUp()
+		spanCtx, s := startSpan(current(), name, "node", tpu)
+		err := f(spanCtx)
+		endSpan(s, err)
+		return err
+	}
+	endBringUp := func(err error) {
+		if bringUp != nil {
+			endSpan(bringUp, err)
+		}
+		bringUp, bringUpCtx, phaseCtx = nil, nil, nil
+	}
 	firstIteration := true
+	wait := 5 * time.Second
+	// failed creates in a row, quota and capacity errors back off further each time
+	createFailures := 0
 	for {
 		if !firstIteration {
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				endBringUp(ctx.Err())
+				return
+			case <-time.After(wait):
+			}
 		}
 		firstIteration = false
+		wait = 5 * time.Second
 		status := &(*statuses)[id]
 		updateStatus := func(err error) {
+			if ctx.Err() != nil {
+				// shutting down, whatever failed was cancelled
+				return
+			}
 			status.mutex.Lock()
+			previous := status.status
 			if err != nil {
 				status.status.id = id
 				status.status.err = err
+				status.status.lastErr = err
+				status.status.lastErrAt = time.Now()
+				events.Error(id, err)
+				if failureOf(err).retryable() {
+					nodeLog.Info("node error", "kind", failureOf(err), "err", err)
+				} else {
+					nodeLog.Warn("node error", "kind", failureOf(err), "err", err)
+				}
 			} else {
 				status.status = TpuStatusUpdate{
 					id:        id,
@@ -117,7 +259,23 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 					installed: installer.basicsInstalled,
 					cloned:    installer.repoCloned,
 					running:   installer.runningPid != -1,
+					stopStage: installer.stopStage,
+					pid:       installer.runningPid,
+					repoHash:  installer.repoClonedHash,
+					raleigh:   installer.raleighInfo,
 					err:       nil,
+					lastErr:   previous.lastErr,
+					lastErrAt: previous.lastErrAt,
+					exited:    previous.exited,
+				}
+				status.status.cordoned, status.status.busy, status.status.action = control.state()
+				events.recordTransitions(id, previous, status.status, cfg.stopSignal)
+				logs.SetRun(id, installer.raleighInfo.GroupId)
+				probes.SetActive(id, installer.runningPid != -1)
+				status.status.probes = probes.Results(id)
+				status.status.ready = status.status.running && probes.Ready(id)
+				if installer.heartbeat != nil {
+					metrics.Record(id, *installer.heartbeat)
 				}
 			}
 			status_val := status.status
@@ -126,59 +284,105 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 			}()
 			status.mutex.Unlock()
 		}
-		newInstaller, err := NewTpuInstaller(cfg, fmt.Sprintf("%s%d", cfg.tpuPrefix, id))
+		reportExit := func(exit exitStatus) {
+			events.record(eventProcessExited, id, fmt.Sprintf("process %s", exit.Describe()))
+			status.mutex.Lock()
+			status.status.exited = &exit
+			status_val := status.status
+			status.mutex.Unlock()
+			go func() {
+				updateChan <- status_val
+			}()
+		}
+		reportStop := func(stage stopStage) {
+			installer.stopStage = stage
+			updateStatus(nil)
+		}
+		newInstaller, err := NewTpuInstaller(ctx, cfg, tpuName(cfg, id))
 		if err != nil {
 			updateStatus(err)
+			wait = retryDelay(err, 0)
 			continue
 		}
 		*installer = *newInstaller
 
-		debugprintf("rank %d, new installer: %v\n", id, installer)
-
 		updateStatus(nil)
-		debugprintf("rank %d, basics installed: %v\n", id, installer.basicsInstalled)
+		nodeLog.Debug("checked node", "status", installer.tpuController.latestStatus, "installed", installer.basicsInstalled, "cloned", installer.repoCloned)
+
+		if action, ok := control.next(); ok {
+			progress := func(progress string) {
+				control.setProgress(progress)
+				updateStatus(nil)
+			}
+			progress("started")
+			actionCtx, actionSpan := startSpan(ctx, "action", "node", tpu, "action", action.String())
+			err = runNodeAction(actionCtx, action, installer, restarts, progress, reportStop)
+			endSpan(actionSpan, err)
+			control.finish(err)
+			_, _, result := control.state()
+			events.record(eventAction, id, result)
+			updateStatus(err)
+			continue
+		}
+		if cordoned, _, _ := control.state(); cordoned {
+			if bringUp != nil {
+				endBringUp(fmt.Errorf("cordoned"))
+			}
+			continue
+		}
 
 		if installer.tpuController.latestStatus != tpuStatusRunning {
 			switch installer.tpuController.latestStatus {
 			case tpuStatusNonexistent:
-				installer.tpuController.start()
+				err = traced("create_tpu", func(ctx context.Context) error { return installer.tpuController.start(ctx) })
+				if err != nil {
+					updateStatus(err)
+					wait = retryDelay(err, createFailures)
+					createFailures++
+				} else {
+					createFailures = 0
+				}
+			case tpuStatusPreempted:
+				updateStatus(kindError("tpu was preempted", failurePreempted))
+				fallthrough
 			case tpuStatusStopped:
-				installer.tpuController.delete()
+				err = traced("delete_tpu", func(ctx context.Context) error { return installer.tpuController.delete(ctx) })
+				if err != nil {
+					updateStatus(err)
+					wait = retryDelay(err, 0)
+				}
 			}
 			continue
 		}
 
+		logs.Stream(ctx, id, *installer.tpuController)
+		probes.Start(ctx, id, *installer.tpuController)
+
 		if !installer.basicsInstalled {
-			err = installer.InstallBasics()
+			err = traced("install_basics", func(ctx context.Context) error { return installer.InstallBasics(ctx) })
 			updateStatus(err)
 			if err != nil {
 				continue
 			}
 		}
 
-		debugprintf("rank %d, basics installed: %v\n", id, installer.basicsInstalled)
-		debugprintf("rank %d, repo cloned: %v\n", id, installer.repoCloned)
-
 		if !installer.repoCloned {
 			if installer.repoClonedHash != "" {
-				err = installer.KillRunningProcess()
+				err = traced("stop_stale_process", func(ctx context.Context) error { return installer.StopRunningProcess(ctx, false, reportStop) })
 				// process may exist, need to kill or verify it's dead
 				updateStatus(err)
 				if err != nil {
 					continue
 				}
-				installer.runningPid = -1
 				installer.repoClonedHash = ""
 			}
-			err = installer.CloneRepo()
+			err = traced("clone_repo", func(ctx context.Context) error { return installer.CloneRepo(ctx) })
 			updateStatus(err)
 			if err != nil {
 				continue
 			}
 		}
 
-		debugprintf("rank %d, repo cloned: %v\n", id, installer.repoCloned)
-
 		lockedMutexes := make([]*sync.Mutex, 0)
 		LockAll := func() {
 			lockedMutexes = make([]*sync.Mutex, 0)
@@ -194,15 +398,12 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 			lockedMutexes = nil
 		}
 
-		debugprintf("rank %d, locked mutexes: %d\n", id, len(lockedMutexes))
-
 		// we only ever lock mutexes one at a time for a brief period so this is fine
 		{
 			LockAll()
 			numActive := 0
 			for i := range len(*statuses) {
-				status := (*statuses)[i].status
-				if status.status == tpuStatusRunning && status.installed && status.cloned {
+				if (*statuses)[i].status.eligible() {
 					numActive++
 				}
 			}
@@ -210,7 +411,7 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 			if numActive < cfg.numTpusActive {
 				continue
 			}
-			debugprintf("rank %d, num active: %d\n", id, numActive)
+			nodeLog.Debug("enough nodes for a group", "active", numActive)
 		}
 
 		// we only ever manage the running TPUs if we get a sufficient number of them up.
@@ -220,18 +421,33 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 		// we want to synchronize the running TPUs once they are all up.
 		// we do this by waiting for the groupWg to be done.
 		// now, all running TPUs are guaranteed to execute the code below.
-		groupWg.Done()
-		debugprintf("rank %d, groupWg done\n", id)
-		groupWg.Wait()
-		debugprintf("rank %d, groupWg waited\n", id)
+		err = traced("join_nodes", func(context.Context) error {
+			groupWg.Done()
+			return waitGroup(ctx, groupWg)
+		})
+		if err != nil {
+			continue
+		}
+		nodeLog.Debug("joined the active nodes")
 
 		// useful primitive. i should have used it more
-		barrier := func() {
-			activeSynchronizer.Sync()
+		// the barriers only fail once ctx is done, and continuing then leads back to a check of ctx
+		barrier := func() error {
+			// only traced while bringing the node up, steady state would be one span every few seconds
+			_, s := childSpan(current(), "barrier")
+			_, err := activeSynchronizer.Sync(ctx)
+			endSpan(s, err)
+			return err
 		}
 		checkErr := func(err error) error {
-			activeSynchronizer.Sync()
-			errors := activeSynchronizer.AllGather(err)
+			_, syncErr := activeSynchronizer.Sync(ctx)
+			if syncErr != nil {
+				return syncErr
+			}
+			errors, syncErr := activeSynchronizer.AllGather(ctx, err)
+			if syncErr != nil {
+				return syncErr
+			}
 			var realErr error = nil
 			for _, err := range errors {
 				if err != nil && err != struct{}{} {
@@ -239,50 +455,69 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 					break
 				}
 			}
-			if realErr != nil {
-				activeSynchronizer.Sync()
-				return realErr
+			_, syncErr = activeSynchronizer.Sync(ctx)
+			if syncErr != nil {
+				return syncErr
 			}
-			activeSynchronizer.Sync()
-			return nil
+			return realErr
 		}
 
-		barrier()
-		debugprintf("rank %d, barrier\n", id)
-
+		if barrier() != nil {
+			continue
+		}
 		groupWg.Add(1)
-		debugprintf("rank %d, groupWg added\n", id)
 
-		barrier()
+		if barrier() != nil {
+			continue
+		}
+		// cordoned nodes that stayed out don't hold the group up, members that get cordoned do
+		members := map[int]bool{}
+		memberIds, err := activeSynchronizer.AllGather(ctx, id)
+		if err != nil {
+			continue
+		}
+		for _, member := range memberIds {
+			members[member.(int)] = true
+		}
 
 		var loadedGroupId int32
 
 		firstInnerIteration := true
 		for {
 			if !firstInnerIteration {
-				time.Sleep(5 * time.Second)
+				// every node shares ctx, so the whole group leaves together
+				select {
+				case <-ctx.Done():
+					endBringUp(ctx.Err())
+					return
+				case <-time.After(5 * time.Second):
+				}
 			}
 			firstInnerIteration = false
 
-			debugprintf("rank %d, first inner iteration: %v\n", id, firstInnerIteration)
-
 			{
-				barrier()
+				if barrier() != nil {
+					continue
+				}
 				loadedGroupId = currentGroupId.Load()
-				barrier()
-				err := checkErr(installer.UpdateStatus())
+				if barrier() != nil {
+					continue
+				}
+				err := checkErr(installer.UpdateStatus(ctx))
 				if err != nil {
 					updateStatus(err)
 					continue
 				}
 				updateStatus(nil)
-				barrier()
+				if barrier() != nil {
+					continue
+				}
 			}
 
-			debugprintf("rank %d, second inner iteration: %v\n", id, firstInnerIteration)
-
 			{
-				barrier()
+				if barrier() != nil {
+					continue
+				}
 
 				// check if all TPUs are still running. if some are not, we exit the active group.
 				// for this block, all active TPUs should have the same state.
@@ -292,46 +527,145 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 					LockAll()
 					for i := range len(*statuses) {
 						status := (*statuses)[i].status
-						if status.status != tpuStatusRunning || !status.installed || !status.cloned {
+						if members[i] && !status.eligible() {
+							// a member was cordoned or has actions queued. running or not, actions
+							// only run outside the group, and a held group would never get to them
+							numNotAlive++
+						} else if members[i] || status.cordoned {
+							continue
+						} else if status.status != tpuStatusRunning || !status.installed || !status.cloned {
+							numNotAlive++
+						} else if status.running && status.busy {
 							numNotAlive++
 						}
 					}
 					UnlockAll()
 				}
 				if numNotAlive > 0 {
-					activeSynchronizer.Sync()
+					nodeLog.Info("leaving the active nodes", "not_alive", numNotAlive)
+					activeSynchronizer.Sync(ctx)
 					break
 				}
 			}
-			barrier()
-
-			debugprintf("rank %d, third inner iteration: %v\n", id, firstInnerIteration)
+			if barrier() != nil {
+				continue
+			}
 
 			{
 				// if we have a current group id, do a health check. check all processes are running
 				// if some are running, but not all, kill the ones that are running.
 				if loadedGroupId > 0 {
 					numRunning := 0
+					runningIds := []int{}
 					{
 						LockAll()
 						for i := range len(*statuses) {
 							status := (*statuses)[i].status
 							if status.status == tpuStatusRunning && status.installed && status.cloned && status.running {
 								numRunning++
+								runningIds = append(runningIds, i)
 							}
 						}
 						UnlockAll()
 					}
 					if numRunning < cfg.numTpusActive {
-						barrier()
+						if barrier() != nil {
+							continue
+						}
+						failed := false
+						if installer.runningPid == -1 {
+							reason := "process vanished without an exit status"
+							failed = true
+							if installer.lastExit != nil && installer.lastExit.GroupId == int(loadedGroupId) {
+								reason = installer.lastExit.Describe()
+								failed = installer.lastExit.Failed()
+								reportExit(*installer.lastExit)
+								err := installer.ArchiveExitStatus(*installer.lastExit)
+								if err != nil {
+									updateStatus(err)
+								}
+							}
+							nodeLog.Warn("process exited", "group", loadedGroupId, "reason", reason)
+							restarts.RecordNodeExit(id, reason)
+						} else {
+							restarts.RecordNodeExit(id, "stopped: another rank exited")
+						}
+						failures, err := activeSynchronizer.AllGather(ctx, failed)
+						if err != nil {
+							continue
+						}
+						anyFailed := false
+						for _, failed := range failures {
+							anyFailed = anyFailed || failed.(bool)
+						}
+						restarts.RecordExit(anyFailed)
+						events.GroupDissolved(int(loadedGroupId), "a process exited")
 						// kill the ones that are running
 						// we do this by setting the group id to 0, the next iteration will kill all running processes
 						currentGroupId.Store(0)
 						loadedGroupId = 0
 						continue
 					}
+
+					// failing liveness probes are treated like the process failing
+					livenessErr := probes.CheckLiveness(id)
+					err := checkErr(livenessErr)
+					if err != nil {
+						if livenessErr != nil {
+							restarts.RecordNodeExit(id, livenessErr.Error())
+						} else {
+							restarts.RecordNodeExit(id, "stopped: another rank failed a liveness probe")
+						}
+						restarts.RecordExit(true)
+						events.GroupDissolved(int(loadedGroupId), err.Error())
+						if barrier() != nil {
+							continue
+						}
+						currentGroupId.Store(0)
+						loadedGroupId = 0
+						continue
+					}
+
+					// the group only counts as launched once every readiness probe passes
+					allReady := true
+					for _, i := range runningIds {
+						allReady = allReady && probes.Ready(i)
+					}
+					readiness, err := activeSynchronizer.AllGather(ctx, allReady)
+					if err != nil {
+						continue
+					}
+					for _, ready := range readiness {
+						allReady = allReady && ready.(bool)
+					}
+					if !allReady {
+						watchdog.Hold(int(loadedGroupId))
+						continue
+					}
+
+					// every process is alive, but a deadlocked collective looks exactly the same.
+					// if nobody made progress for a while, grab diagnostics and stop the group.
+					err = checkErr(watchdog.CheckHang(int(loadedGroupId), runningIds))
+					if err != nil {
+						nodeLog.Warn("group hung", "group", loadedGroupId, "err", err)
+						dir, dirErr := hangDiagnosticsDir(int(loadedGroupId))
+						if dirErr == nil {
+							dirErr = installer.CollectDiagnostics(ctx, dir, tail(logs.Lines(id), 200))
+						}
+						if dirErr != nil {
+							updateStatus(dirErr)
+						}
+						restarts.RecordNodeExit(id, err.Error())
+						restarts.RecordExit(true)
+						events.GroupDissolved(int(loadedGroupId), err.Error())
+						if barrier() != nil {
+							continue
+						}
+						currentGroupId.Store(0)
+						loadedGroupId = 0
+						continue
+					}
 				} else {
-					debugprintf("rank %d, fourth inner iteration: %v\n", id, firstInnerIteration)
 					// if no TPUs have a running PID, we create a new group id and start all processes together.
 					numNotRunning := 0
 					{
@@ -344,41 +678,80 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 						}
 						UnlockAll()
 					}
-					debugprintf("rank %d, fifth inner iteration: %v %d\n", id, firstInnerIteration, numNotRunning)
+					nodeLog.Debug("no group running", "not_running", numNotRunning)
 					if numNotRunning >= cfg.numTpusActive {
-						// all TPUs are not running. we can create a new group id.
-						barrier()
+						// all TPUs are not running. we can create a new group id,
+						// unless the restart policy, backoff or crash loop detection holds us back.
+						err := checkErr(restarts.CheckStart())
+						if err != nil {
+							nodeLog.Debug("start held", "reason", err)
+							updateStatus(nil)
+							continue
+						}
+						startBringUp()
+						formCtx, formSpan := startSpan(bringUpCtx, "form_group", "node", tpu)
+						phaseCtx = formCtx
+						formFailed := func(err error) {
+							endSpan(formSpan, err)
+							phaseCtx = nil
+						}
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
 						currentGroupId.Store(int32(rand.IntN(1000000) + 1))
-						barrier()
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
 						attemptedGroupId := currentGroupId.Load()
-						barrier()
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
 						currentGroupId.Store(0)
-						myIndex := activeSynchronizer.Sync()
-						debugprintf("rank %d, my index: %d, creating new group id: %d\n", id, myIndex, attemptedGroupId)
-						myPorts, err := installer.GetUnusedPorts(cfg.numTpusActive - 1)
-						debugprintf("rank %d, my index: %d, my ports: %v\n", id, myIndex, myPorts)
+						myIndex, err := activeSynchronizer.Sync(ctx)
+						if err != nil {
+							formFailed(err)
+							continue
+						}
+						groupLog := nodeLog.With("group", attemptedGroupId, "index", myIndex)
+						groupLog.Info("forming group")
+						formSpan.SetAttributes(spanAttrs("group", int(attemptedGroupId), "index", myIndex)...)
+						var myPorts []int
+						err = traced("get_ports", func(ctx context.Context) error {
+							myPorts, err = installer.GetUnusedPorts(ctx, cfg.numTpusActive-1)
+							return err
+						})
 						err = checkErr(err)
-						debugprintf("err: %v\n", err)
 						if err != nil {
-							debugprintf("rank %d, error getting unused ports: %v\n", id, err)
+							groupLog.Error("error getting unused ports", "err", err)
+							formFailed(err)
 							updateStatus(err)
 							continue
 						}
-						barrier()
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
 						myHost := make([][]any, len(myPorts))
 						for i, port := range myPorts {
 							myHost[i] = []any{installer.tpuController.latestInfo.IP, port}
 						}
-						debugprintf("rank %d, my host: %v\n", id, myHost)
-						allHostsRaw := activeSynchronizer.AllGather(hostSync{host: myHost, index: myIndex})
-						debugprintf("rank %d, my hosts: %v, all hosts raw: %v\n", id, myHost, allHostsRaw)
-						barrier()
+						allHostsRaw, err := activeSynchronizer.AllGather(ctx, hostSync{host: myHost, index: myIndex})
+						if err != nil {
+							formFailed(err)
+							continue
+						}
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
 						allHosts := make([][][]any, len(allHostsRaw))
 						for _, raw := range allHostsRaw {
 							hs := raw.(hostSync)
 							allHosts[hs.index] = hs.host
 						}
-						debugprintf("rank %d, all hosts: %v\n", id, allHosts)
 						otherHosts := make([][]any, len(myPorts))
 						for i := range len(allHosts) {
 							if i == myIndex {
@@ -386,47 +759,70 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 							}
 							otherHosts[posmod((i-myIndex), len(allHosts))-1] = allHosts[i][posmod((myIndex-i), len(allHosts))-1]
 						}
-						debugprintf("rank %d (%d), other hosts: %v\n", id, myIndex, otherHosts)
-						barrier()
-						err = installer.WriteRaleighInfo(raleighInfo{
-							Ports:   myPorts,
-							GroupId: int(attemptedGroupId),
-							Seed:    myPorts[0],
-							Hosts:   otherHosts,
+						groupLog.Debug("exchanged hosts", "ports", myPorts, "hosts", otherHosts)
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
+						err = traced("write_raleigh_info", func(ctx context.Context) error {
+							return installer.WriteRaleighInfo(ctx, raleighInfo{
+								Ports:   myPorts,
+								GroupId: int(attemptedGroupId),
+								Seed:    myPorts[0],
+								Hosts:   otherHosts,
+							})
 						})
-						debugprintf("rank %d, wrote raleigh info with err: %v\n", id, err)
 						err = checkErr(err)
 						if err != nil {
 							updateStatus(err)
-							debugprintf("rank %d, error writing raleigh info: %v\n", id, err)
+							groupLog.Error("error writing raleigh info", "err", err)
+							formFailed(err)
+							continue
+						}
+						logs.SetRun(id, int(attemptedGroupId))
+						if err := barrier(); err != nil {
+							formFailed(err)
 							continue
 						}
-						debugprintf("rank %d, wrote raleigh info\n", id)
-						barrier()
 						currentGroupId.Store(attemptedGroupId)
-						barrier()
-						debugprintf("rank %d, starting process\n", id)
-						err = installer.StartProcess()
-						debugprintf("rank %d, started process with err: %v\n", id, err)
+						if err := barrier(); err != nil {
+							formFailed(err)
+							continue
+						}
+						// a launch that fails outright still counts towards backoff and crash loops
+						restarts.RecordStart(attemptedGroupId, id)
+						err = traced("start_process", func(ctx context.Context) error { return installer.StartProcess(ctx) })
 						err = checkErr(err)
 						if err != nil {
 							updateStatus(err)
-							debugprintf("rank %d, error starting process: %v\n", id, err)
+							groupLog.Error("error starting process", "err", err)
+							formFailed(err)
 							continue
 						}
-						debugprintf("rank %d, started process\n", id)
+						endSpan(formSpan, nil)
+						endBringUp(nil)
+						events.GroupFormed(int(attemptedGroupId), cfg.numTpusActive)
+						groupLog.Info("started process", "pid", installer.runningPid)
 					} else {
-						barrier()
+						if barrier() != nil {
+							continue
+						}
 						// we need to kill some of the running processes
-						// specifically, we kill the process on the TPU we own.
-						err := installer.KillRunningProcess()
+						// specifically, we stop the process on the TPU we own.
+						// every rank delivers the stop signal (so everyone can checkpoint) before any rank escalates.
+						err := checkErr(traced("stop_signal", func(ctx context.Context) error { return installer.SendStopSignal(ctx, reportStop) }))
+						if err != nil {
+							updateStatus(err)
+							nodeLog.Error("error signalling process", "err", err)
+							continue
+						}
+						err = traced("stop_process", func(ctx context.Context) error { return installer.StopRunningProcess(ctx, true, reportStop) })
 						err = checkErr(err)
 						if err != nil {
 							updateStatus(err)
-							debugprintf("rank %d, error killing process: %v\n", id, err)
+							nodeLog.Error("error killing process", "err", err)
 							continue
 						}
-						installer.runningPid = -1
 						installer.repoClonedHash = ""
 						continue
 					}
@@ -436,7 +832,9 @@ func Watch(cfg TpuConfig, id int, installer *TpuInstaller, updateChan chan TpuSt
 	}
 }
 
-func NewTpuWatcher(cfg TpuConfig) *TpuWatcher {
+// NewTpuWatcher starts watching the fleet until ctx is done, which also cancels whatever
+// the nodes are running at the time.
+func NewTpuWatcher(ctx context.Context, cfg TpuConfig) *TpuWatcher {
 	tpuInstallers := make([]*TpuInstaller, cfg.numTpus)
 	channel := make(chan TpuStatusUpdate)
 	statuses := make([]TpuCurrentStatus, cfg.numTpus)
@@ -446,13 +844,34 @@ func NewTpuWatcher(cfg TpuConfig) *TpuWatcher {
 	groupWg.Add(cfg.numTpusActive)
 	currentGroupId := atomic.Int32{}
 	currentGroupId.Store(0) // TODO load from one of the active TPUs
-	for i := 0; i < cfg.numTpus; i++ {
-		tpuInstallers[i] = &TpuInstaller{}
-		go Watch(cfg, i, tpuInstallers[i], channel, &statuses, &groupWg, &activeSynchronizer, &currentGroupId)
-	}
-	return &TpuWatcher{
+	restarts := newRestartTracker(cfg)
+	metrics := newMetricsStore(cfg.numTpus)
+	logs := newLogHub(cfg, metrics)
+	watchdog := newWatchdog(cfg, metrics, logs)
+	probes := newProbeRunner(cfg, cfg.probes)
+	controls := make([]*nodeControl, cfg.numTpus)
+	events := newEventLog()
+	watcher := &TpuWatcher{
+		cfg:           cfg,
 		tpuInstallers: tpuInstallers,
 		updates:       channel,
 		statuses:      statuses,
+		restarts:      restarts,
+		logs:          logs,
+		metrics:       metrics,
+		watchdog:      watchdog,
+		probes:        probes,
+		controls:      controls,
+		events:        events,
+		started:       time.Now(),
+	}
+	if cfg.metricsAddr != "" {
+		go serveMetrics(watcher)
+	}
+	for i := 0; i < cfg.numTpus; i++ {
+		tpuInstallers[i] = &TpuInstaller{}
+		controls[i] = &nodeControl{}
+		go Watch(ctx, cfg, i, tpuInstallers[i], channel, &statuses, &groupWg, &activeSynchronizer, &currentGroupId, restarts, logs, metrics, watchdog, probes, controls[i], events)
 	}
+	return watcher
 }
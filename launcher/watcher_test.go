@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSynchronizerAllGather(t *testing.T) {
+	s := Synchronizer{}
+	s.Add(3)
+	results := make(chan []int, 3)
+	for id := range 3 {
+		go func() {
+			for round := range 5 {
+				values, err := s.AllGather(context.Background(), id*10+round)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids := []int{}
+				for _, value := range values {
+					ids = append(ids, value.(int)/10)
+				}
+				slices.Sort(ids)
+				if round == 4 {
+					results <- ids
+				}
+			}
+		}()
+	}
+	for range 3 {
+		select {
+		case ids := <-results:
+			if !slices.Equal(ids, []int{0, 1, 2}) {
+				t.Errorf("gathered from %v, want every node", ids)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("AllGather never finished")
+		}
+	}
+}
+
+func TestSynchronizerCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		wait func(ctx context.Context, s *Synchronizer) error
+	}{
+		{"sync", func(ctx context.Context, s *Synchronizer) error {
+			_, err := s.Sync(ctx)
+			return err
+		}},
+		{"all gather", func(ctx context.Context, s *Synchronizer) error {
+			_, err := s.AllGather(ctx, 1)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := Synchronizer{}
+			s.Add(3)
+			ctx, cancel := context.WithCancel(context.Background())
+			errs := make(chan error, 2)
+			// the third node never shows up
+			for range 2 {
+				go func() {
+					errs <- test.wait(ctx, &s)
+				}()
+			}
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+			for range 2 {
+				select {
+				case err := <-errs:
+					if !errors.Is(err, context.Canceled) {
+						t.Errorf("err = %v, want context.Canceled", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("still waiting after ctx was cancelled")
+				}
+			}
+		})
+	}
+}